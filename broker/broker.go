@@ -0,0 +1,658 @@
+// Package broker is a small MQTT 3.1.1 and MQTT 5 broker that runs inside the process.
+//
+// It supports retained messages, QoS 0 and 1, wills, and wildcard
+// subscriptions.  QoS 2 subscriptions are granted at QoS 1.  Every session
+// is treated as a clean session; nothing is kept for a client after it
+// disconnects.  Usernames and passwords are accepted unchecked unless an
+// authenticator is set.  For TLS, pass Serve() a listener from crypto/tls.
+//
+// MQTT 5 clients get reason codes, and message expiry and user properties
+// are passed along to them.  Topic aliases, shared subscriptions, subscription
+// identifiers, and will delays are not supported.
+//
+// It is meant for tests, which can start one on a random port, and for
+// small installations that want to run the broker in the same binary as
+// their devices.
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a client has to send CONNECT, and to accept each packet we write
+const connectTimeout = 10 * time.Second
+const writeTimeout = 10 * time.Second
+
+// The largest packet a client may send unless SetMaxPacketSize() says otherwise
+const DefaultMaxPacketSize = 1 << 20
+
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+	props   []property // MQTT 5 properties for subscribers
+	expires time.Time  // zero if the message does not expire
+}
+
+type Broker struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	clients  map[string]*client // indexed by client ID
+	retained map[string]message // indexed by topic
+	closed   bool
+	counter  int // used to generate client IDs
+
+	maxPacketSize int
+
+	authenticate func(clientID, username, password string) bool
+	authorize    func(clientID, topic string) bool
+}
+
+type client struct {
+	broker        *Broker
+	conn          net.Conn
+	id            string
+	version       byte // protocol level: 3 or 4 for MQTT 3.1, 3.1.1; 5 for MQTT 5
+	will          *message
+	keepAlive     time.Duration
+	subscriptions map[string]byte // filter to QoS.  Guarded by the broker's mutex
+
+	writeMutex sync.Mutex
+	nextId     uint16 // packet ID for QoS 1 messages.  Guarded by writeMutex
+}
+
+func New() *Broker {
+	var b Broker
+
+	b.clients = make(map[string]*client)
+	b.retained = make(map[string]message)
+	b.maxPacketSize = DefaultMaxPacketSize
+
+	return &b
+}
+
+// Check the credentials of each client that connects.  Clients the
+// authenticator refuses are turned away with "bad user name or password".
+// Set it before listening.
+func (b *Broker) SetAuthenticator(authenticate func(clientID, username, password string) bool) {
+	b.authenticate = authenticate
+}
+
+// Decide which topics each client may publish to.  Messages the authorizer
+// refuses are dropped; MQTT 5 clients are told "not authorized".
+// Set it before listening.
+func (b *Broker) SetAuthorizer(authorize func(clientID, topic string) bool) {
+	b.authorize = authorize
+}
+
+// Limit the size of the packets clients send, counting the fixed header.
+// A client that sends a larger packet is dropped, and its will is published.
+// MQTT 5 clients are told the limit when they connect.  Set it before listening.
+func (b *Broker) SetMaxPacketSize(size int) {
+	if size < 2 || size > 268435460 {
+		panic(fmt.Sprintf("packet size %d out of range", size))
+	}
+	b.maxPacketSize = size
+}
+
+// Listen on a TCP address, e.g. ":1883", and serve in the background.
+// Use "127.0.0.1:0" to listen on a random port.
+func (b *Broker) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if err := b.setListener(l); err != nil {
+		return err
+	}
+	go b.serve(l)
+	return nil
+}
+
+// Accept and serve connections until the listener is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	if err := b.setListener(l); err != nil {
+		return err
+	}
+	return b.serve(l)
+}
+
+func (b *Broker) setListener(l net.Listener) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		l.Close()
+		return errors.New("broker is closed")
+	}
+	b.listener = l
+	return nil
+}
+
+func (b *Broker) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			b.mutex.Lock()
+			closed := b.closed
+			b.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go b.handle(conn)
+	}
+}
+
+// The address the broker is listening on, or nil if it is not listening.
+func (b *Broker) Addr() net.Addr {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+// The URL clients use to reach the broker, e.g. "tcp://127.0.0.1:1883",
+// or "" if it is not listening.
+func (b *Broker) URL() string {
+	addr := b.Addr()
+	if addr == nil {
+		return ""
+	}
+	return "tcp://" + addr.String()
+}
+
+// Stop listening and drop every client.  Wills are not published.
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	l := b.listener
+	clients := b.clients
+	b.clients = make(map[string]*client)
+	b.mutex.Unlock()
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+	if l != nil {
+		return l.Close()
+	}
+	return nil
+}
+
+// Serve one client connection
+func (b *Broker) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(r, b.maxPacketSize)
+	if err != nil || p.pType != pktConnect {
+		conn.Close()
+		return
+	}
+
+	c, code := b.connect(conn, p)
+	conn.Write(c.connack(code).encode())
+	if code != connAccepted {
+		conn.Close()
+		return
+	}
+
+	err = c.serve(r)
+
+	// Publish the will unless the client said goodbye
+	b.mutex.Lock()
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+	closed := b.closed
+	b.mutex.Unlock()
+	if err != nil && c.will != nil && !closed {
+		b.publish(*c.will)
+	}
+	conn.Close()
+}
+
+// Process a CONNECT packet.  Returns the client and the CONNACK return code.
+// The client is only registered if the connection is accepted.
+func (b *Broker) connect(conn net.Conn, p *packet) (*client, byte) {
+	c := &client{broker: b, conn: conn, version: 4, subscriptions: make(map[string]byte)}
+
+	protocol, err := p.readString()
+	if err != nil {
+		return c, connBadProtocol
+	}
+	level, err := p.readByte()
+	if err != nil || !((protocol == "MQTT" && (level == 4 || level == 5)) || (protocol == "MQIsdp" && level == 3)) {
+		return c, connBadProtocol
+	}
+	c.version = level
+	flags, err := p.readByte()
+	if err != nil {
+		return c, connBadProtocol
+	}
+	keepAlive, err := p.readUint16()
+	if err != nil {
+		return c, connBadProtocol
+	}
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+	if c.version == 5 {
+		if _, err := p.readProperties(); err != nil {
+			return c, connBadProtocol
+		}
+	}
+
+	if c.id, err = p.readString(); err != nil {
+		return c, connIdentifierRefused
+	}
+
+	if flags&0x04 != 0 {
+		var will message
+		if c.version == 5 {
+			props, err := p.readProperties()
+			if err != nil {
+				return c, connBadProtocol
+			}
+			will.setProperties(props)
+		}
+		will.topic, err = p.readString()
+		if err != nil || !validTopic(will.topic) {
+			return c, connBadProtocol
+		}
+		if will.payload, err = p.readBytes(); err != nil {
+			return c, connBadProtocol
+		}
+		will.payload = append([]byte(nil), will.payload...)
+		will.qos = min((flags>>3)&0x03, 1)
+		will.retain = flags&0x20 != 0
+		c.will = &will
+	}
+
+	var username, password string
+	if flags&0x80 != 0 {
+		if username, err = p.readString(); err != nil {
+			return c, connBadProtocol
+		}
+	}
+	if flags&0x40 != 0 {
+		if password, err = p.readString(); err != nil {
+			return c, connBadProtocol
+		}
+	}
+	if b.authenticate != nil && !b.authenticate(c.id, username, password) {
+		return c, connBadCredentials
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(c.id) == 0 {
+		if flags&0x02 == 0 {
+			return c, connIdentifierRefused
+		}
+		b.counter++
+		c.id = fmt.Sprintf("broker-%d", b.counter)
+	}
+
+	// A new connection with the same ID takes over from the old one
+	if old, ok := b.clients[c.id]; ok {
+		old.conn.Close()
+	}
+	b.clients[c.id] = c
+
+	return c, connAccepted
+}
+
+// The CONNACK for a CONNACK return code, in the client's protocol
+func (c *client) connack(code byte) *packetWriter {
+	if c.version != 5 {
+		return newPacket(pktConnack, 0).byte(0).byte(code)
+	}
+	return newPacket(pktConnack, 0).byte(0).byte(connReasons[code]).properties([]property{
+		{propSubIdsAvailable, []byte{0}},
+		{propSharedSubsAvailable, []byte{0}},
+		{propMaximumPacketSize, binary.BigEndian.AppendUint32(nil, uint32(c.broker.maxPacketSize))},
+	})
+}
+
+// Read and process packets until the client disconnects.
+// Returns nil if the client sent DISCONNECT.
+func (c *client) serve(r *bufio.Reader) error {
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := readPacket(r, c.broker.maxPacketSize)
+		if err != nil {
+			return err
+		}
+
+		switch p.pType {
+		case pktPublish:
+			err = c.receivePublish(p)
+		case pktPubrel:
+			// end of an incoming QoS 2 exchange.  The message was delivered on PUBLISH.
+			var id uint16
+			if id, err = p.readUint16(); err == nil {
+				err = c.write(newPacket(pktPubcomp, 0).uint16(id))
+			}
+		case pktPuback, pktPubrec, pktPubcomp:
+			// we never resend, so acknowledgements need no work
+		case pktSubscribe:
+			err = c.subscribe(p)
+		case pktUnsubscribe:
+			err = c.unsubscribe(p)
+		case pktPingreq:
+			err = c.write(newPacket(pktPingresp, 0))
+		case pktDisconnect:
+			// An MQTT 5 client may ask for its will to be published
+			if reason, err := p.readByte(); err != nil || reason != reasonDisconnectWithWill {
+				c.will = nil
+			}
+			return nil
+		default:
+			err = fmt.Errorf("unexpected packet type %d", p.pType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) receivePublish(p *packet) error {
+	var (
+		m   message
+		id  uint16
+		err error
+	)
+
+	m.qos = (p.flags >> 1) & 0x03
+	m.retain = p.flags&0x01 != 0
+	if m.topic, err = p.readString(); err != nil {
+		return err
+	}
+	if !validTopic(m.topic) {
+		return fmt.Errorf("invalid topic %s", m.topic)
+	}
+	if m.qos > 0 {
+		if id, err = p.readUint16(); err != nil {
+			return err
+		}
+	}
+	if c.version == 5 {
+		props, err := p.readProperties()
+		if err != nil {
+			return err
+		}
+		m.setProperties(props)
+	}
+	m.payload = append([]byte(nil), p.body[p.offset:]...)
+
+	reason := byte(reasonSuccess)
+	if c.broker.authorize != nil && !c.broker.authorize(c.id, m.topic) {
+		reason = reasonNotAuthorized
+	} else {
+		c.broker.publish(m)
+	}
+
+	var ack *packetWriter
+	switch m.qos {
+	case 1:
+		ack = newPacket(pktPuback, 0).uint16(id)
+	case 2:
+		ack = newPacket(pktPubrec, 0).uint16(id)
+	default:
+		return nil
+	}
+	if c.version == 5 && reason != reasonSuccess {
+		ack.byte(reason).properties([]property{stringProperty(propReasonString, "not authorized to publish to "+m.topic)})
+	}
+	return c.write(ack)
+}
+
+func (c *client) subscribe(p *packet) error {
+	var (
+		granted []byte
+		matched []message
+	)
+
+	id, err := p.readUint16()
+	if err != nil {
+		return err
+	}
+	if c.version == 5 {
+		if _, err := p.readProperties(); err != nil {
+			return err
+		}
+	}
+
+	b := c.broker
+	b.mutex.Lock()
+	for p.remaining() > 0 {
+		filter, err := p.readString()
+		if err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		options, err := p.readByte()
+		if err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		// MQTT 5 subscription options other than the QoS are ignored
+		qos := options
+		if c.version == 5 {
+			qos = options & 0x03
+		}
+		if !validFilter(filter) || qos > 2 {
+			granted = append(granted, 0x80)
+			continue
+		}
+		qos = min(qos, 1)
+		c.subscriptions[filter] = qos
+		granted = append(granted, qos)
+
+		for topic, m := range b.retained {
+			if _, live := m.deliveryProperties(); !live {
+				delete(b.retained, topic)
+				continue
+			}
+			if FilterMatches(filter, m.topic) {
+				m.qos = min(m.qos, qos)
+				matched = append(matched, m)
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	suback := newPacket(pktSuback, 0).uint16(id)
+	if c.version == 5 {
+		suback.properties(nil)
+	}
+	if err := c.write(suback.bytes(granted)); err != nil {
+		return err
+	}
+
+	// Now send the retained messages for the new subscriptions
+	for _, m := range matched {
+		if err := c.deliver(m, m.qos, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) unsubscribe(p *packet) error {
+	id, err := p.readUint16()
+	if err != nil {
+		return err
+	}
+	if c.version == 5 {
+		if _, err := p.readProperties(); err != nil {
+			return err
+		}
+	}
+
+	var reasons []byte
+	b := c.broker
+	b.mutex.Lock()
+	for p.remaining() > 0 {
+		filter, err := p.readString()
+		if err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		if _, ok := c.subscriptions[filter]; ok {
+			reasons = append(reasons, reasonSuccess)
+		} else {
+			reasons = append(reasons, reasonNoSubscriptionExisted)
+		}
+		delete(c.subscriptions, filter)
+	}
+	b.mutex.Unlock()
+
+	unsuback := newPacket(pktUnsuback, 0).uint16(id)
+	if c.version == 5 {
+		unsuback.properties(nil).bytes(reasons)
+	}
+	return c.write(unsuback)
+}
+
+// Publish a message to every subscriber, and retain it if asked to.
+func (b *Broker) publish(m message) {
+	type delivery struct {
+		c   *client
+		qos byte
+	}
+	var deliveries []delivery
+
+	b.mutex.Lock()
+	if m.retain {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m
+		}
+	}
+
+	for _, c := range b.clients {
+		matched := false
+		qos := byte(0)
+		for filter, subQos := range c.subscriptions {
+			if FilterMatches(filter, m.topic) {
+				matched = true
+				qos = max(qos, subQos)
+			}
+		}
+		if matched {
+			deliveries = append(deliveries, delivery{c, min(qos, m.qos)})
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, d := range deliveries {
+		if err := d.c.deliver(m, d.qos, false); err != nil {
+			d.c.conn.Close()
+		}
+	}
+}
+
+// Send a message to a client.  Messages that have expired are dropped.
+func (c *client) deliver(m message, qos byte, retain bool) error {
+	props, live := m.deliveryProperties()
+	if !live {
+		return nil
+	}
+
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	w := newPacket(pktPublish, flags).string(m.topic)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if qos > 0 {
+		c.nextId++
+		if c.nextId == 0 {
+			c.nextId = 1
+		}
+		w.uint16(c.nextId)
+	}
+	if c.version == 5 {
+		w.properties(props)
+	}
+	w.bytes(m.payload)
+	return c.writeLocked(w)
+}
+
+func (c *client) write(w *packetWriter) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeLocked(w)
+}
+
+func (c *client) writeLocked(w *packetWriter) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(w.encode())
+	return err
+}
+
+// Topic names may not be empty, and may not contain wildcards
+func validTopic(topic string) bool {
+	return len(topic) > 0 && !strings.ContainsAny(topic, "+#")
+}
+
+// In a topic filter, + must stand alone in its level, and # must stand alone in the last level
+func validFilter(filter string) bool {
+	if len(filter) == 0 {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// Does a topic filter match a topic?  Exported for clients that dispatch
+// messages to handlers by subscription.
+// Wildcards in the first level do not match topics that begin with $.
+func FilterMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
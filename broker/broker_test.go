@@ -0,0 +1,365 @@
+package broker
+
+// test the broker, using the paho client
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"testing"
+	"time"
+)
+
+func startBroker(t *testing.T) *Broker {
+	b := New()
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func connectClient(t *testing.T, b *Broker, id string) mqtt.Client {
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID(id)
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("MQTT Connect failed: %v", token.Error())
+	}
+	t.Cleanup(func() { c.Disconnect(0) })
+	return c
+}
+
+// Subscribe, and return a channel that carries "topic payload" for each message
+func collect(t *testing.T, c mqtt.Client, filter string, qos byte) chan string {
+	messages := make(chan string, 100)
+	token := c.Subscribe(filter, qos, func(c mqtt.Client, m mqtt.Message) {
+		messages <- m.Topic() + " " + string(m.Payload())
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("MQTT Subscribe failed: %v", token.Error())
+	}
+	return messages
+}
+
+func expectMessage(t *testing.T, messages chan string, expected string) {
+	select {
+	case m := <-messages:
+		if m != expected {
+			t.Errorf("received \"%s\", expected \"%s\"", m, expected)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("did not receive \"%s\"", expected)
+	}
+}
+
+func expectNothing(t *testing.T, messages chan string) {
+	select {
+	case m := <-messages:
+		t.Errorf("received unexpected \"%s\"", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	b := startBroker(t)
+	pub := connectClient(t, b, "pub")
+	sub := connectClient(t, b, "sub")
+
+	messages := collect(t, sub, "homie/+/$state", 1)
+	pub.Publish("homie/dev-a/$state", 1, false, "ready").Wait()
+	pub.Publish("homie/dev-a/$name", 0, false, "Device A").Wait()
+	pub.Publish("homie/dev-b/$state", 0, false, "init").Wait()
+
+	expectMessage(t, messages, "homie/dev-a/$state ready")
+	expectMessage(t, messages, "homie/dev-b/$state init")
+	expectNothing(t, messages)
+}
+
+func TestBroker_Retained(t *testing.T) {
+	b := startBroker(t)
+	pub := connectClient(t, b, "pub")
+
+	pub.Publish("homie/dev-a/$name", 1, true, "Device A").Wait()
+	pub.Publish("homie/dev-a/$state", 1, true, "ready").Wait()
+	pub.Publish("homie/dev-a/$state", 1, true, "").Wait() // clears it
+	pub.Publish("other/topic", 1, true, "x").Wait()
+
+	sub := connectClient(t, b, "sub")
+	messages := collect(t, sub, "homie/#", 1)
+	expectMessage(t, messages, "homie/dev-a/$name Device A")
+	expectNothing(t, messages)
+}
+
+func TestBroker_Will(t *testing.T) {
+	b := startBroker(t)
+	sub := connectClient(t, b, "sub")
+	messages := collect(t, sub, "homie/dev-a/$state", 1)
+
+	// Connect with a will, then drop the connection without saying goodbye
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	connect := newPacket(pktConnect, 0).string("MQTT").byte(4).
+		byte(0x02 | 0x04 | 0x08 | 0x20).uint16(60).string("dropper").
+		string("homie/dev-a/$state").string("lost")
+	conn.Write(connect.encode())
+	connack := make([]byte, 4)
+	if _, err := conn.Read(connack); err != nil || connack[3] != connAccepted {
+		t.Fatalf("CONNACK %v, err %v", connack, err)
+	}
+	conn.Close()
+
+	expectMessage(t, messages, "homie/dev-a/$state lost")
+
+	// The will was retained
+	late := connectClient(t, b, "late")
+	expectMessage(t, collect(t, late, "homie/#", 0), "homie/dev-a/$state lost")
+}
+
+// A client that sends a packet over the limit is dropped before the broker reads it
+func TestBroker_MaxPacketSize(t *testing.T) {
+	b := New()
+	b.SetMaxPacketSize(64)
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer b.Close()
+	sub := connectClient(t, b, "sub")
+	messages := collect(t, sub, "homie/#", 1)
+
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	connect := newPacket(pktConnect, 0).string("MQTT").byte(4).
+		byte(0x02 | 0x04).uint16(60).string("big").
+		string("homie/dev-a/$state").string("lost")
+	conn.Write(connect.encode())
+	connack := make([]byte, 4)
+	if _, err := conn.Read(connack); err != nil || connack[3] != connAccepted {
+		t.Fatalf("CONNACK %v, err %v", connack, err)
+	}
+
+	// A PUBLISH that claims 100 bytes, and never sends them
+	conn.Write([]byte{pktPublish << 4, 100})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(connack); err == nil {
+		t.Errorf("connection was not dropped")
+	}
+	expectMessage(t, messages, "homie/dev-a/$state lost")
+
+	// Smaller packets get through
+	pub := connectClient(t, b, "pub")
+	pub.Publish("homie/dev-a/$state", 1, false, "ready").Wait()
+	expectMessage(t, messages, "homie/dev-a/$state ready")
+}
+
+func TestBroker_URL(t *testing.T) {
+	b := New()
+	if url := b.URL(); url != "" {
+		t.Errorf("broker that is not listening has URL %s", url)
+	}
+	b = startBroker(t)
+	if url := b.URL(); url != "tcp://"+b.Addr().String() {
+		t.Errorf("broker has URL %s", url)
+	}
+}
+
+func TestBroker_CleanDisconnect(t *testing.T) {
+	b := startBroker(t)
+	sub := connectClient(t, b, "sub")
+	messages := collect(t, sub, "homie/#", 1)
+
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("polite")
+	opts.SetWill("homie/dev-a/$state", "lost", 1, true)
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("MQTT Connect failed: %v", token.Error())
+	}
+	c.Disconnect(50)
+
+	expectNothing(t, messages)
+}
+
+func TestBroker_Unsubscribe(t *testing.T) {
+	b := startBroker(t)
+	pub := connectClient(t, b, "pub")
+	sub := connectClient(t, b, "sub")
+
+	messages := collect(t, sub, "a/b", 1)
+	pub.Publish("a/b", 1, false, "1").Wait()
+	expectMessage(t, messages, "a/b 1")
+
+	sub.Unsubscribe("a/b").Wait()
+	pub.Publish("a/b", 1, false, "2").Wait()
+	expectNothing(t, messages)
+}
+
+func TestBroker_Filters(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		matches       bool
+	}{
+		{"homie/#", "homie/dev/$state", true},
+		{"homie/#", "homie", true},
+		{"homie/+/$state", "homie/dev/$state", true},
+		{"homie/+/$state", "homie/dev/node/$state", false},
+		{"homie/+", "homie", false},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/b", "a/b/c", false},
+	}
+	for _, c := range cases {
+		if FilterMatches(c.filter, c.topic) != c.matches {
+			t.Errorf("filter %s topic %s: expected match %v", c.filter, c.topic, c.matches)
+		}
+	}
+
+	for _, f := range []string{"a/#/b", "a/b#", "a+/b", ""} {
+		if validFilter(f) {
+			t.Errorf("filter \"%s\" accepted", f)
+		}
+	}
+}
+
+func TestBroker_Authenticator(t *testing.T) {
+	b := New()
+	b.SetAuthenticator(func(clientID, username, password string) bool {
+		return username == "plug" && password == "secret"
+	})
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer b.Close()
+
+	for _, c := range []struct {
+		username, password string
+		accepted           bool
+	}{
+		{"plug", "secret", true},
+		{"plug", "guess", false},
+		{"", "", false},
+	} {
+		opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("auth")
+		opts.SetUsername(c.username)
+		opts.SetPassword(c.password)
+		client := mqtt.NewClient(opts)
+		token := client.Connect()
+		token.Wait()
+		if (token.Error() == nil) != c.accepted {
+			t.Errorf("%s/%s: connect error %v", c.username, c.password, token.Error())
+		}
+		client.Disconnect(0)
+	}
+}
+
+// Connect an MQTT 5 client.  Each message received goes on the channel.
+func connectClient5(t *testing.T, b *Broker, id string) (*paho.Client, chan *paho.Publish) {
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	messages := make(chan *paho.Publish, 100)
+	c := paho.NewClient(paho.ClientConfig{
+		Conn: conn,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(r paho.PublishReceived) (bool, error) {
+				messages <- r.Packet
+				return true, nil
+			},
+		},
+	})
+	if _, err := c.Connect(context.Background(), &paho.Connect{ClientID: id, KeepAlive: 60, CleanStart: true}); err != nil {
+		t.Fatalf("MQTT 5 Connect failed: %v", err)
+	}
+	t.Cleanup(func() { c.Disconnect(&paho.Disconnect{}) })
+	return c, messages
+}
+
+func expectPublish(t *testing.T, messages chan *paho.Publish, topic, payload string) *paho.Publish {
+	select {
+	case m := <-messages:
+		if m.Topic != topic || string(m.Payload) != payload {
+			t.Errorf("received %s \"%s\", expected %s \"%s\"", m.Topic, m.Payload, topic, payload)
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Errorf("did not receive %s \"%s\"", topic, payload)
+		return nil
+	}
+}
+
+func TestBroker_MQTT5(t *testing.T) {
+	b := New()
+	b.SetAuthorizer(func(clientID, topic string) bool {
+		return topic != "forbidden"
+	})
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	pub, _ := connectClient5(t, b, "pub5")
+	sub, messages := connectClient5(t, b, "sub5")
+	if _, err := sub.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: "homie/#", QoS: 1}},
+	}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	old := connectClient(t, b, "old")
+	oldMessages := collect(t, old, "homie/#", 1)
+
+	// User properties go to MQTT 5 subscribers, the message alone to 3.1.1 ones
+	var props paho.UserProperties
+	props.Add("reason", "testing")
+	if _, err := pub.Publish(ctx, &paho.Publish{
+		Topic: "homie/dev/on", QoS: 1, Payload: []byte("true"),
+		Properties: &paho.PublishProperties{User: props},
+	}); err != nil {
+		t.Errorf("Publish failed: %v", err)
+	}
+	if m := expectPublish(t, messages, "homie/dev/on", "true"); m != nil {
+		if m.Properties == nil || m.Properties.User.Get("reason") != "testing" {
+			t.Errorf("user property was not passed along: %+v", m.Properties)
+		}
+	}
+	expectMessage(t, oldMessages, "homie/dev/on true")
+
+	// Refused publications carry a reason code
+	if _, err := pub.Publish(ctx, &paho.Publish{Topic: "forbidden", QoS: 1, Payload: []byte("x")}); err == nil {
+		t.Errorf("publish to forbidden topic succeeded")
+	}
+
+	// Retained messages expire
+	expiry := uint32(1)
+	pub.Publish(ctx, &paho.Publish{
+		Topic: "homie/dev/event", QoS: 1, Retain: true, Payload: []byte("ring"),
+		Properties: &paho.PublishProperties{MessageExpiry: &expiry},
+	})
+	pub.Publish(ctx, &paho.Publish{Topic: "homie/dev/name", QoS: 1, Retain: true, Payload: []byte("Dev")})
+	expectPublish(t, messages, "homie/dev/event", "ring")
+	expectPublish(t, messages, "homie/dev/name", "Dev")
+	time.Sleep(1100 * time.Millisecond)
+
+	late, lateMessages := connectClient5(t, b, "late5")
+	if _, err := late.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: "homie/#", QoS: 1}},
+	}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectPublish(t, lateMessages, "homie/dev/name", "Dev")
+	select {
+	case m := <-lateMessages:
+		t.Errorf("received unexpected %s \"%s\"", m.Topic, m.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := late.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{"homie/#"}}); err != nil {
+		t.Errorf("Unsubscribe failed: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package broker
+
+//
+// This file contains code to read and write MQTT control packets.
+//
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Control packet types
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktPuback      = 4
+	pktPubrec      = 5
+	pktPubrel      = 6
+	pktPubcomp     = 7
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+// CONNACK return codes
+const (
+	connAccepted          = 0
+	connBadProtocol       = 1
+	connIdentifierRefused = 2
+	connBadCredentials    = 4
+)
+
+// MQTT 5 reason codes
+const (
+	reasonSuccess               = 0x00
+	reasonDisconnectWithWill    = 0x04
+	reasonNoSubscriptionExisted = 0x11
+	reasonNotAuthorized         = 0x87
+)
+
+// MQTT 5 CONNACK reason codes for the 3.1.1 return codes
+var connReasons = map[byte]byte{
+	connAccepted:          0x00,
+	connBadProtocol:       0x84, // unsupported protocol version
+	connIdentifierRefused: 0x85, // client identifier not valid
+	connBadCredentials:    0x86, // bad user name or password
+}
+
+var (
+	errMalformed = errors.New("malformed packet")
+	errTooLarge  = errors.New("packet too large")
+)
+
+type packet struct {
+	pType  byte
+	flags  byte
+	body   []byte
+	offset int // read position in body
+}
+
+// Read a packet of at most maxSize bytes, counting the fixed header.
+// A larger packet is refused before its body is read.
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+	var p packet
+
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	p.pType = header >> 4
+	p.flags = header & 0x0f
+
+	length, size := 0, 1
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return nil, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		size++
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if size+length > maxSize {
+		return nil, errTooLarge
+	}
+
+	p.body = make([]byte, length)
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *packet) remaining() int {
+	return len(p.body) - p.offset
+}
+
+func (p *packet) readByte() (byte, error) {
+	if p.remaining() < 1 {
+		return 0, errMalformed
+	}
+	p.offset++
+	return p.body[p.offset-1], nil
+}
+
+func (p *packet) readUint16() (uint16, error) {
+	if p.remaining() < 2 {
+		return 0, errMalformed
+	}
+	p.offset += 2
+	return binary.BigEndian.Uint16(p.body[p.offset-2:]), nil
+}
+
+func (p *packet) readBytes() ([]byte, error) {
+	n, err := p.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if p.remaining() < int(n) {
+		return nil, errMalformed
+	}
+	p.offset += int(n)
+	return p.body[p.offset-int(n) : p.offset], nil
+}
+
+func (p *packet) readString() (string, error) {
+	b, err := p.readBytes()
+	return string(b), err
+}
+
+// Builds a packet to be written
+type packetWriter struct {
+	header byte
+	body   []byte
+}
+
+func newPacket(pType, flags byte) *packetWriter {
+	return &packetWriter{header: pType<<4 | flags&0x0f}
+}
+
+func (w *packetWriter) byte(b byte) *packetWriter {
+	w.body = append(w.body, b)
+	return w
+}
+
+func (w *packetWriter) uint16(n uint16) *packetWriter {
+	w.body = binary.BigEndian.AppendUint16(w.body, n)
+	return w
+}
+
+func (w *packetWriter) string(s string) *packetWriter {
+	w.uint16(uint16(len(s)))
+	w.body = append(w.body, s...)
+	return w
+}
+
+func (w *packetWriter) bytes(b []byte) *packetWriter {
+	w.body = append(w.body, b...)
+	return w
+}
+
+// The complete packet, fixed header included
+func (w *packetWriter) encode() []byte {
+	b := []byte{w.header}
+	length := len(w.body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(b, w.body...)
+}
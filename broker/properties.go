@@ -0,0 +1,193 @@
+package broker
+
+//
+// This file contains code to read and write MQTT 5 properties.
+// The broker acts on few of them; the rest are checked and passed along.
+//
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Property identifiers the broker looks at
+const (
+	propMessageExpiry          = 0x02
+	propSubscriptionIdentifier = 0x0b
+	propReasonString           = 0x1f
+	propWillDelay              = 0x18
+	propTopicAlias             = 0x23
+	propMaximumPacketSize      = 0x27
+	propSubIdsAvailable        = 0x29
+	propSharedSubsAvailable    = 0x2a
+)
+
+// The encoding of each property's value
+const (
+	propByte = iota
+	propUint16
+	propUint32
+	propVarint
+	propString // strings and binary data
+	propPair   // user properties
+)
+
+var propTypes = map[byte]int{
+	0x01: propByte,   // payload format indicator
+	0x02: propUint32, // message expiry interval
+	0x03: propString, // content type
+	0x08: propString, // response topic
+	0x09: propString, // correlation data
+	0x0b: propVarint, // subscription identifier
+	0x11: propUint32, // session expiry interval
+	0x12: propString, // assigned client identifier
+	0x13: propUint16, // server keep alive
+	0x15: propString, // authentication method
+	0x16: propString, // authentication data
+	0x17: propByte,   // request problem information
+	0x18: propUint32, // will delay interval
+	0x19: propByte,   // request response information
+	0x1a: propString, // response information
+	0x1c: propString, // server reference
+	0x1f: propString, // reason string
+	0x21: propUint16, // receive maximum
+	0x22: propUint16, // topic alias maximum
+	0x23: propUint16, // topic alias
+	0x24: propByte,   // maximum QoS
+	0x25: propByte,   // retain available
+	0x26: propPair,   // user property
+	0x27: propUint32, // maximum packet size
+	0x28: propByte,   // wildcard subscription available
+	0x29: propByte,   // subscription identifiers available
+	0x2a: propByte,   // shared subscriptions available
+}
+
+// One property, its value still encoded
+type property struct {
+	id    byte
+	value []byte
+}
+
+func (p *packet) readVarint() (int, error) {
+	n := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, errMalformed
+		}
+		b, err := p.readByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+}
+
+// Read the properties of an MQTT 5 packet
+func (p *packet) readProperties() ([]property, error) {
+	length, err := p.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if p.remaining() < length {
+		return nil, errMalformed
+	}
+	end := p.offset + length
+
+	var props []property
+	for p.offset < end {
+		id, _ := p.readByte()
+		t, ok := propTypes[id]
+		if !ok {
+			return nil, errMalformed
+		}
+
+		start := p.offset
+		switch t {
+		case propByte:
+			_, err = p.readByte()
+		case propUint16:
+			_, err = p.readUint16()
+		case propUint32:
+			if p.remaining() < 4 {
+				err = errMalformed
+			}
+			p.offset += 4
+		case propVarint:
+			_, err = p.readVarint()
+		case propString:
+			_, err = p.readBytes()
+		case propPair:
+			if _, err = p.readBytes(); err == nil {
+				_, err = p.readBytes()
+			}
+		}
+		if err != nil || p.offset > end {
+			return nil, errMalformed
+		}
+		props = append(props, property{id, p.body[start:p.offset]})
+	}
+	return props, nil
+}
+
+func (w *packetWriter) varint(n int) *packetWriter {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		w.body = append(w.body, digit)
+		if n == 0 {
+			return w
+		}
+	}
+}
+
+// Write the property length, then the properties
+func (w *packetWriter) properties(props []property) *packetWriter {
+	length := 0
+	for _, p := range props {
+		length += 1 + len(p.value)
+	}
+	w.varint(length)
+	for _, p := range props {
+		w.body = append(w.body, p.id)
+		w.body = append(w.body, p.value...)
+	}
+	return w
+}
+
+// Take the properties of a PUBLISH, or of a will, that go to subscribers.
+// The message expiry interval becomes a deadline, and is written afresh on delivery.
+func (m *message) setProperties(props []property) {
+	m.props = nil
+	for _, p := range props {
+		switch p.id {
+		case propMessageExpiry:
+			m.expires = time.Now().Add(time.Duration(binary.BigEndian.Uint32(p.value)) * time.Second)
+		case propTopicAlias, propSubscriptionIdentifier, propWillDelay:
+		default:
+			m.props = append(m.props, property{p.id, append([]byte(nil), p.value...)})
+		}
+	}
+}
+
+// The properties to deliver with a message.  False if it has expired.
+func (m *message) deliveryProperties() ([]property, bool) {
+	if m.expires.IsZero() {
+		return m.props, true
+	}
+	left := time.Until(m.expires)
+	if left <= 0 {
+		return nil, false
+	}
+	seconds := uint32((left + time.Second - 1) / time.Second)
+	return append(append([]property(nil), m.props...), property{propMessageExpiry, binary.BigEndian.AppendUint32(nil, seconds)}), true
+}
+
+func stringProperty(id byte, s string) property {
+	return property{id, append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)}
+}
@@ -1,9 +1,9 @@
-module kasaplug
+module github.com/duke1swd/homieGo
 
 go 1.25.1
 
 require (
-	github.com/duke1swd/homieGo v0.0.0-20230102180507-4c4529c8e72e
+	github.com/eclipse/paho.golang v0.23.0
 	github.com/eclipse/paho.mqtt.golang v1.5.1
 )
 
@@ -0,0 +1,152 @@
+package homietest
+
+//
+// This file contains code to compare retained topics against golden files.
+//
+// A golden file has one retained topic per line: the topic, a space, and the payload.
+// Blank lines and lines starting with # are ignored.  {base} and {id} stand for
+// the device's topic base and ID.  A payload of * matches any value.
+//
+//	{base}/{id}/$state disconnected
+//	{base}/{id}/$nodes light,switch
+//	{base}/{id}/$stats/uptime *
+//
+// Run the tests with -update to rewrite the golden files from what the devices published.
+// Wildcards already in a file are kept.
+//
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// Attributes that are comma separated lists in no particular order
+var listAttributes = map[string]bool{
+	"$nodes":      true,
+	"$properties": true,
+	"$extensions": true,
+}
+
+// Compare the retained topics against a golden file, after the device is stopped.
+func (h *Harness) Golden(path string) {
+	h.T.Helper()
+
+	base := h.Device.TopicBase()
+	id := h.Device.Id()
+	actual := h.Recorder.Retained()
+
+	if *update {
+		expected, _ := readGolden(path, base, id)
+		if err := writeGolden(path, base, id, expected, actual); err != nil {
+			h.T.Fatalf("%v", err)
+		}
+		return
+	}
+
+	expected, err := readGolden(path, base, id)
+	if err != nil {
+		h.T.Fatalf("%v", err)
+	}
+	Compare(h.T, expected, actual)
+}
+
+// Compare a map of topics to payloads against what was expected.
+// An expected payload of "*" matches anything, and list attributes such as $nodes
+// match in any order.  Reports every missing, different, and unexpected topic.
+func Compare(t testing.TB, expected, actual map[string]string) {
+	t.Helper()
+
+	for _, topic := range sortedTopics(expected) {
+		v := expected[topic]
+		if v2, ok := actual[topic]; !ok {
+			t.Errorf("Did not find topic %s", topic)
+		} else if !payloadMatches(topic, v, v2) {
+			t.Errorf("For topic %s expected value \"%s\" found value \"%s\"", topic, v, v2)
+		}
+	}
+
+	for _, topic := range sortedTopics(actual) {
+		if _, ok := expected[topic]; !ok {
+			t.Errorf("Did not expect %s: %s", topic, actual[topic])
+		}
+	}
+}
+
+func payloadMatches(topic, expected, actual string) bool {
+	if expected == "*" || expected == actual {
+		return true
+	}
+	if !listAttributes[topic[strings.LastIndex(topic, "/")+1:]] {
+		return false
+	}
+
+	e := strings.Split(expected, ",")
+	a := strings.Split(actual, ",")
+	sort.Strings(e)
+	sort.Strings(a)
+	return strings.Join(e, ",") == strings.Join(a, ",")
+}
+
+func sortedTopics(m map[string]string) []string {
+	topics := make([]string, 0, len(m))
+	for topic := range m {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func readGolden(path, base, id string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := strings.NewReplacer("{base}", base, "{id}", id)
+	expected := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		topic, payload, found := strings.Cut(line, " ")
+		if !found || len(payload) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected a topic and a payload", path, lineNumber)
+		}
+		expected[r.Replace(topic)] = payload
+	}
+	return expected, scanner.Err()
+}
+
+// Write the actual topics, keeping the wildcards in what was expected
+func writeGolden(path, base, id string, expected, actual map[string]string) error {
+	var b strings.Builder
+
+	for _, topic := range sortedTopics(actual) {
+		payload := actual[topic]
+		if expected[topic] == "*" {
+			payload = "*"
+		}
+
+		levels := strings.Split(topic, "/")
+		for i, level := range levels {
+			if i == 0 && level == base {
+				levels[i] = "{base}"
+			} else if level == id {
+				levels[i] = "{id}"
+			}
+		}
+		fmt.Fprintf(&b, "%s %s\n", strings.Join(levels, "/"), payload)
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,112 @@
+// Package homietest helps test devices built with the homie library.
+//
+// Start() runs a device against a Recorder, a transport that captures
+// everything the device publishes.  The test can then send the device
+// set and broadcast messages, wait for the device to publish what it
+// should, and compare the retained topics against a golden file.
+//
+//	func TestLamp(t *testing.T) {
+//		d := homie.NewDevice("lamp", "Lamp")
+//		...
+//		h := homietest.Start(t, d)
+//		h.Set("light", "on", "true")
+//		h.WaitFor("light/on", "true")
+//		h.Stop()
+//		h.Golden("testdata/lamp.golden")
+//	}
+package homietest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/duke1swd/homieGo/library"
+)
+
+// How long the Harness waits for the device before failing the test
+const DefaultTimeout = 5 * time.Second
+
+// A device running against a Recorder
+type Harness struct {
+	T        testing.TB
+	Device   *homie.Device
+	Recorder *Recorder
+	Timeout  time.Duration
+
+	cancel      context.CancelFunc
+	waitChannel chan bool
+	stopped     bool
+}
+
+// Run the device, and wait for it to publish $state "ready".
+// The device is stopped and destroyed when the test ends, if Stop() has not been called.
+func Start(t testing.TB, d *homie.Device) *Harness {
+	t.Helper()
+
+	h := &Harness{
+		T:           t,
+		Device:      d,
+		Recorder:    NewRecorder(),
+		Timeout:     DefaultTimeout,
+		waitChannel: make(chan bool, 1),
+	}
+	d.SetTransport(h.Recorder)
+
+	var c context.Context
+	c, h.cancel = context.WithCancel(context.Background())
+	go d.RunWithContext(c, h.waitChannel)
+	t.Cleanup(h.Stop)
+
+	h.WaitFor("$state", "ready")
+	return h
+}
+
+// Stop the device, wait for the run loop to finish, and destroy the device.
+// Everything the device published is in the Recorder by the time Stop returns.
+func (h *Harness) Stop() {
+	if h.stopped {
+		return
+	}
+	h.stopped = true
+
+	h.cancel()
+	for _ = range h.waitChannel {
+	}
+	h.Device.Destroy()
+}
+
+// The topic of a device attribute, node, or property, such as "$state" or "light/on".
+// Under v4 if the device speaks it, otherwise under v5.
+func (h *Harness) Topic(t string) string {
+	if h.Device.Protocols()&homie.HomieV4 != 0 {
+		return h.Device.TopicBase() + "/" + h.Device.Id() + "/" + t
+	}
+	return h.Device.TopicBase() + "/5/" + h.Device.Id() + "/" + t
+}
+
+// Send the device a set message for a property.
+// The device's handlers have run by the time Set returns.
+// For one index of a span, give the node ID with the index, "relay_3" under v4 or "relay-3" under v5.
+func (h *Harness) Set(node, property, value string) {
+	h.Recorder.Inject(h.Topic(node+"/"+property+"/set"), value, false)
+}
+
+// Send a broadcast message to every device on the device's topic base.
+func (h *Harness) Broadcast(level, value string) {
+	base := h.Device.TopicBase() + "/$broadcast/"
+	if h.Device.Protocols()&homie.HomieV4 == 0 {
+		base = h.Device.TopicBase() + "/5/$broadcast/"
+	}
+	h.Recorder.Inject(base+level, value, false)
+}
+
+// Wait for the device to publish value on a topic given relative to the device.
+// A value of "*" matches anything.  Fails the test on timeout.
+func (h *Harness) WaitFor(topic, value string) {
+	h.T.Helper()
+
+	if err := h.Recorder.WaitFor(h.Topic(topic), value, h.Timeout); err != nil {
+		h.T.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package homietest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/duke1swd/homieGo/library"
+)
+
+func createLamp(id string) (*homie.Device, *homie.Property) {
+	d := homie.NewDevice(id, "Lamp")
+	d.SetTopicBase("testing")
+	d.SetStatsProvider(homie.StatCpuLoad, nil) // not on every platform
+	d.SetStatsProvider(homie.StatFreeHeap, nil)
+	light := d.NewNode("light", "Light", "lamp", nil)
+	light.Advertise("level", "Level", homie.DtInteger).SetFormat("0:100")
+	on := light.Advertise("on", "On", homie.DtBoolean)
+	on.SettableBool(func(d *homie.Device, n *homie.Node, p *homie.Property, value bool) bool {
+		p.SetProperty().SendBool(value)
+		return true
+	})
+	d.NewNode("switch", "Switch", "switch", nil)
+	return d, on
+}
+
+func TestHarness_Golden(t *testing.T) {
+	d, _ := createLamp("golden-lamp")
+	h := Start(t, d)
+	h.Set("light", "on", "true")
+	h.WaitFor("light/on", "true")
+	h.Stop()
+
+	h.Golden("testdata/lamp.golden")
+}
+
+func TestHarness_Broadcast(t *testing.T) {
+	d, _ := createLamp("broadcast-lamp")
+	received := make(chan string, 1)
+	d.SetBroadcastHandler(func(d *homie.Device, level, value string) {
+		received <- level + " " + value
+	})
+
+	h := Start(t, d)
+	h.Broadcast("alert", "fire")
+	if r := <-received; r != "alert fire" {
+		t.Errorf("received broadcast \"%s\"", r)
+	}
+}
+
+func TestHarness_V5(t *testing.T) {
+	d, _ := createLamp("v5-lamp")
+	d.SetProtocols(homie.HomieV5)
+	h := Start(t, d)
+
+	if h.Topic("$state") != "testing/5/v5-lamp/$state" {
+		t.Errorf("topic is %s", h.Topic("$state"))
+	}
+	h.Set("light", "on", "true")
+	h.WaitFor("light/on", "true")
+	h.Stop()
+
+	if w := h.Recorder.Will(); w == nil || w.Topic != "testing/5/v5-lamp/$state" {
+		t.Errorf("will is %+v", w)
+	}
+	if _, ok := h.Recorder.Retained()["testing/v5-lamp/$state"]; ok {
+		t.Errorf("v5 only device published under v4")
+	}
+}
+
+func TestRecorder_WaitFor(t *testing.T) {
+	r := NewRecorder()
+	go r.Publish("a/b", 1, true, "1")
+	if err := r.WaitFor("a/b", "1", DefaultTimeout); err != nil {
+		t.Errorf("%v", err)
+	}
+	if err := r.WaitFor("a/b", "2", 0); err == nil {
+		t.Errorf("waiting for the wrong value succeeded")
+	}
+	if err := r.WaitFor("a/c", "*", 0); err == nil {
+		t.Errorf("waiting for an unpublished topic succeeded")
+	}
+}
+
+// Collects the errors Compare reports
+type errorCollector struct {
+	testing.TB
+	errors []string
+}
+
+func (c *errorCollector) Helper() {}
+func (c *errorCollector) Errorf(format string, args ...any) {
+	c.errors = append(c.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCompare(t *testing.T) {
+	expected := map[string]string{
+		"h/d/$nodes":        "a,b,c",
+		"h/d/$stats/uptime": "*",
+		"h/d/$name":         "D",
+		"h/d/$fw/name":      "x",
+		"h/d/a/$properties": "p,q",
+	}
+	actual := map[string]string{
+		"h/d/$nodes":        "c,a,b",
+		"h/d/$stats/uptime": "17",
+		"h/d/$name":         "d",
+		"h/d/a/$properties": "p",
+		"h/d/$mac":          "00:11",
+	}
+	c := &errorCollector{TB: t}
+	Compare(c, expected, actual)
+
+	want := []string{
+		`Did not find topic h/d/$fw/name`,
+		`For topic h/d/$name expected value "D" found value "d"`,
+		`For topic h/d/a/$properties expected value "p,q" found value "p"`,
+		`Did not expect h/d/$mac: 00:11`,
+	}
+	if fmt.Sprint(c.errors) != fmt.Sprint(want) {
+		t.Errorf("errors are\n%q\nexpected\n%q", c.errors, want)
+	}
+}
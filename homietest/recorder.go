@@ -0,0 +1,214 @@
+package homietest
+
+//
+// This file contains the Recorder, a transport that stands in for the broker.
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/duke1swd/homieGo/broker"
+	"github.com/duke1swd/homieGo/library"
+)
+
+// One message published by the device
+type Message struct {
+	Topic    string
+	Payload  string
+	Qos      byte
+	Retained bool
+}
+
+// A homie.Transport that acts like a broker with no other clients.
+// It records everything published through it, keeps the retained
+// messages, and delivers injected messages to the subscribers.
+type Recorder struct {
+	mutex         sync.Mutex
+	messages      []Message
+	retained      map[string]string
+	subscriptions map[string]func(topic string, payload []byte)
+	will          *homie.Will
+	connected     bool
+	changed       chan struct{} // closed, and replaced, on every publication
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		retained:      make(map[string]string),
+		subscriptions: make(map[string]func(topic string, payload []byte)),
+		changed:       make(chan struct{}),
+	}
+}
+
+// A token that is already complete
+type doneToken struct{}
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                   { return nil }
+func (t doneToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+func (r *Recorder) Connect(will *homie.Will, onConnect func(), onLost func(err error)) homie.Token {
+	r.mutex.Lock()
+	r.will = will
+	r.connected = true
+	r.mutex.Unlock()
+
+	go onConnect()
+	return doneToken{}
+}
+
+func (r *Recorder) Publish(topic string, qos byte, retained bool, payload string) homie.Token {
+	r.mutex.Lock()
+	r.messages = append(r.messages, Message{Topic: topic, Payload: payload, Qos: qos, Retained: retained})
+	handlers := r.store(topic, payload, retained)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mutex.Unlock()
+
+	// Like a broker, deliver out of another go routine
+	for _, handler := range handlers {
+		go handler(topic, []byte(payload))
+	}
+	return doneToken{}
+}
+
+// Keep a retained message, and find the subscribers for a topic.
+// Must hold the mutex.
+func (r *Recorder) store(topic, payload string, retained bool) []func(topic string, payload []byte) {
+	if retained {
+		if len(payload) == 0 {
+			delete(r.retained, topic)
+		} else {
+			r.retained[topic] = payload
+		}
+	}
+
+	handlers := make([]func(topic string, payload []byte), 0, 1)
+	for filter, handler := range r.subscriptions {
+		if broker.FilterMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
+
+func (r *Recorder) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) homie.Token {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.subscriptions[topic] = handler
+	for t, payload := range r.retained {
+		if broker.FilterMatches(topic, t) {
+			go handler(t, []byte(payload))
+		}
+	}
+	return doneToken{}
+}
+
+func (r *Recorder) Unsubscribe(topic string) homie.Token {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.subscriptions, topic)
+	return doneToken{}
+}
+
+func (r *Recorder) Disconnect(quiesce time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.connected = false
+	r.subscriptions = make(map[string]func(topic string, payload []byte))
+}
+
+// Deliver a message to the device, as if another client had published it.
+// The subscription handlers have run by the time Inject returns.
+// The message is not recorded as one of the device's.
+func (r *Recorder) Inject(topic, payload string, retained bool) {
+	r.mutex.Lock()
+	handlers := r.store(topic, payload, retained)
+	r.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(topic, []byte(payload))
+	}
+}
+
+// Everything published so far, in order
+func (r *Recorder) Messages() []Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Message(nil), r.messages...)
+}
+
+// A copy of the retained messages, injected ones included
+func (r *Recorder) Retained() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	m := make(map[string]string, len(r.retained))
+	for k, v := range r.retained {
+		m[k] = v
+	}
+	return m
+}
+
+// The will given to Connect(), or nil
+func (r *Recorder) Will() *homie.Will {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.will
+}
+
+func (r *Recorder) IsConnected() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.connected
+}
+
+// Wait until the last message published to topic carries payload.
+// A payload of "*" matches any value.
+func (r *Recorder) WaitFor(topic, payload string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		r.mutex.Lock()
+		last, found := r.last(topic)
+		changed := r.changed
+		r.mutex.Unlock()
+
+		if found && (payload == "*" || last == payload) {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			if found {
+				return fmt.Errorf("topic %s is \"%s\", waited for \"%s\"", topic, last, payload)
+			}
+			return fmt.Errorf("topic %s was not published, waited for \"%s\"", topic, payload)
+		}
+	}
+}
+
+// The last payload published to a topic.  Must hold the mutex.
+func (r *Recorder) last(topic string) (string, bool) {
+	for i := len(r.messages) - 1; i >= 0; i-- {
+		if r.messages[i].Topic == topic {
+			return r.messages[i].Payload, true
+		}
+	}
+	return "", false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -33,6 +34,7 @@ type kasaDevice struct {
 	id   string // homie id
 	name string // homie friendly name
 	addr net.Addr
+	mac  string // as reported by the plug, "" if not
 	on   bool
 
 	lastSeen       time.Time
@@ -59,6 +61,10 @@ var (
 	network           string
 	lostDeviceTimeout time.Duration
 	mqttBroker        string
+	mqttUser          string
+	mqttPassword      string
+	mqttTLS           *tls.Config // nil if not configured
+	mqttVersion       int
 	fullLogFileName   string
 )
 
@@ -112,6 +118,28 @@ func init() {
 	if s, ok := os.LookupEnv("MQTTBROKER"); ok {
 		mqttBroker = s
 	}
+	mqttVersion = homie.MqttV311
+	if os.Getenv("MQTTVERSION") == "5" {
+		mqttVersion = homie.MqttV5
+	}
+	mqttUser = os.Getenv("MQTTUSER")
+	mqttPassword = os.Getenv("MQTTPASSWORD")
+
+	// TLS is configured if any of its variables are set
+	tlsOptions := homie.TLSOptions{
+		CAFile:             os.Getenv("MQTTCAFILE"),
+		CertFile:           os.Getenv("MQTTCERTFILE"),
+		KeyFile:            os.Getenv("MQTTKEYFILE"),
+		ServerName:         os.Getenv("MQTTSERVERNAME"),
+		InsecureSkipVerify: os.Getenv("MQTTINSECURE") == "true",
+	}
+	if tlsOptions != (homie.TLSOptions{}) {
+		mqttTLS, err = tlsOptions.Config()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Kasaplug: Bad TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	if l, ok := os.LookupEnv("LOGDIR"); ok {
 		logDirectory = l
@@ -366,6 +394,11 @@ func tp2kasa(gmap map[string]interface{}) (*kasaDevice, bool) {
 		return nil, false
 	}
 
+	// Not every model reports its MAC, so this one is optional
+	if m, ok := gmap["mac"]; ok {
+		kasa.mac, _ = m.(string)
+	}
+
 	r, ok := gmap["relay_state"]
 	if !ok {
 		if debug {
@@ -424,19 +457,48 @@ func (kasa *kasaDevice) setValue(value string) {
 }
 
 // This function creates the homie device, its node, and its properties
-func createHomieDevice(kasa *kasaDevice) {
+// Returns false if the plug cannot be made into a homie device.
+func createHomieDevice(kasa *kasaDevice) bool {
 	var c context.Context
 
 	logMessage(fmt.Sprintf("Kasaplug: Creating device for %s with ID %s", kasa.name, kasa.id))
 
-	// create the device
-	kasa.hDevice = homie.NewDevice(kasa.id, kasa.name)
+	// create the device.  The ID comes from the plug's alias, which may not make a good one.
+	hDevice, err := homie.TryNewDevice(kasa.id, kasa.name)
+	if err != nil {
+		logMessage(fmt.Sprintf("Kasaplug: Cannot create device for %s: %v", kasa.name, err))
+		return false
+	}
+	kasa.hDevice = hDevice
 	if len(topicBase) > 0 {
-		kasa.hDevice.SetTopicBase(topicBase)
+		if err := kasa.hDevice.TrySetTopicBase(topicBase); err != nil {
+			logMessage(fmt.Sprintf("Kasaplug: Cannot create device for %s: %v", kasa.name, err))
+			kasa.hDevice.Destroy()
+			return false
+		}
 	}
 	if len(mqttBroker) > 0 {
 		kasa.hDevice.SetMqttBroker(mqttBroker)
 	}
+	kasa.hDevice.SetMqttVersion(mqttVersion)
+	if len(mqttUser) > 0 {
+		kasa.hDevice.SetMqttCredentials(mqttUser, mqttPassword)
+	}
+	if mqttTLS != nil {
+		kasa.hDevice.SetTLSConfig(mqttTLS)
+	}
+	// Publish the plug's address rather than ours
+	if u, ok := kasa.addr.(*net.UDPAddr); ok {
+		kasa.hDevice.SetLocalIP(u.IP.String())
+	}
+	if len(kasa.mac) > 0 {
+		if err := kasa.hDevice.TrySetMac(kasa.mac); err != nil {
+			logMessage(fmt.Sprintf("Kasaplug: Device %s: %v", kasa.name, err))
+		}
+	}
+	kasa.hDevice.SetErrorHandler(func(d *homie.Device, err error) {
+		logMessage(fmt.Sprintf("Kasaplug: Device %s: %v", kasa.name, err))
+	})
 
 	// it has one node
 	node := kasa.hDevice.NewNode("outlet", "outlet", "relay", nil)
@@ -460,12 +522,16 @@ func createHomieDevice(kasa *kasaDevice) {
 		s = "true"
 	}
 	property.SetProperty().Send(s)
+	return true
 }
 
-func destroyHomieDevice(kasa *kasaDevice) {
+// If purge is set, the device's topics are cleared from the broker.
+// Otherwise they are left, marked disconnected, in case the plug comes back.
+func destroyHomieDevice(kasa *kasaDevice, purge bool) {
 
 	logMessage(fmt.Sprintf("Kasaplug: Destroying kasa device %s", kasa.name))
 	delete(kasaMap, kasa.uid)
+	kasa.hDevice.SetPurgeOnExit(purge)
 	kasa.cancelFunction()
 	for _ = range kasa.waitChan {
 	}
@@ -498,9 +564,11 @@ func run(c context.Context, deviceChannel chan map[string]interface{}) {
 				// uid already matches
 				if oldK.id != kasa.id || oldK.name != kasa.name {
 					// device has been programmed to a new identity
-					// destroy the old device and create the new one
-					destroyHomieDevice(oldK)
-					createHomieDevice(kasa)
+					// destroy the old device, and its topics, and create the new one
+					destroyHomieDevice(oldK, true)
+					if !createHomieDevice(kasa) {
+						break
+					}
 					oldK = kasa
 				}
 
@@ -520,7 +588,9 @@ func run(c context.Context, deviceChannel chan map[string]interface{}) {
 				kasaMap[kasa.uid] = oldK
 			} else {
 				// New device.  Create it
-				createHomieDevice(kasa)
+				if !createHomieDevice(kasa) {
+					break
+				}
 				kasa.lastSeen = time.Now()
 				kasaMap[kasa.uid] = kasa
 			}
@@ -532,7 +602,7 @@ func run(c context.Context, deviceChannel chan map[string]interface{}) {
 			// Scan for any devices we have not seen in awhile.
 			for _, k := range kasaMap {
 				if time.Since(k.lastSeen) > lostDeviceTimeout {
-					destroyHomieDevice(k)
+					destroyHomieDevice(k, false)
 				}
 			}
 
@@ -0,0 +1,78 @@
+package homie
+
+//
+// This file contains the code for $localip and $mac.
+// Unless they are set, they are found on each connection to the broker,
+// from the local address the transport uses to reach it.
+//
+
+import (
+	"net"
+	"strings"
+)
+
+// Publish ip as $localip rather than the address used to reach the broker.
+// For example, a bridge may want the address of the device it stands in for.
+func (d *Device) SetLocalIP(ip string) {
+	if d.configDone.Load() {
+		panic("Cannot set local IP on running device " + d.id)
+	}
+	if net.ParseIP(ip) == nil {
+		panic("Invalid local IP " + ip + " for device " + d.id)
+	}
+	d.localIP = ip
+	d.localIPFixed = true
+}
+
+// Publish mac as $mac rather than the MAC of the interface used to reach the broker.
+func (d *Device) SetMac(mac string) {
+	if d.configDone.Load() {
+		panic("Cannot set MAC on running device " + d.id)
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		panic("Invalid MAC " + mac + " for device " + d.id)
+	}
+	d.mac = strings.ToUpper(hw.String())
+	d.macFixed = true
+}
+
+// Find the local address, and the MAC of its interface, if the transport can tell us.
+// Called on each connection, as either may have changed since the last.
+func (d *Device) updateAddresses() {
+	t, ok := d.transport.(LocalAddresser)
+	if !ok {
+		return
+	}
+	ip := t.LocalAddr()
+	if ip == nil {
+		return
+	}
+
+	if !d.localIPFixed {
+		d.localIP = ip.String()
+	}
+	if !d.macFixed {
+		d.mac = macOf(ip)
+	}
+}
+
+// The MAC of the interface with address ip, or "" if there isn't one
+func macOf(ip net.IP) string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, i := range interfaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return strings.ToUpper(i.HardwareAddr.String())
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package homie
+
+// test $localip and $mac
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runAddressTestDevice(d *Device) map[string]string {
+	f := newFakeTransport()
+	d.SetTransport(f)
+	c, cfl := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	d.RunWithContext(c, make(chan bool, 1))
+	cfl()
+	return f.retainedMessages()
+}
+
+func TestAddress_FromTransport(t *testing.T) {
+	d := createTestDevice()
+	retained := runAddressTestDevice(d)
+
+	if ip := retained[d.topic("$localip")]; ip != "127.0.0.1" {
+		t.Errorf("$localip is \"%s\"", ip)
+	}
+	if mac, ok := retained[d.topic("$mac")]; ok {
+		t.Errorf("loopback has $mac \"%s\"", mac)
+	}
+}
+
+func TestAddress_Override(t *testing.T) {
+	d := createTestDevice()
+	d.SetLocalIP("192.168.1.40")
+	d.SetMac("50:c7:bf:01:02:03")
+	retained := runAddressTestDevice(d)
+
+	if ip := retained[d.topic("$localip")]; ip != "192.168.1.40" {
+		t.Errorf("$localip is \"%s\"", ip)
+	}
+	if mac := retained[d.topic("$mac")]; mac != "50:C7:BF:01:02:03" {
+		t.Errorf("$mac is \"%s\"", mac)
+	}
+
+	expectPanic := func(what string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", what)
+			}
+		}()
+		f()
+	}
+	expectPanic("bad IP", func() { d.SetLocalIP("192.168.1") })
+	expectPanic("bad MAC", func() { d.SetMac("50:c7:bf") })
+}
+
+func TestAddress_Mac(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("no interfaces: %v", err)
+	}
+	for _, i := range interfaces {
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			n, ok := a.(*net.IPNet)
+			if !ok || len(i.HardwareAddr) == 0 {
+				continue
+			}
+			if mac := macOf(n.IP); mac != strings.ToUpper(i.HardwareAddr.String()) {
+				t.Errorf("MAC of %v is \"%s\", expected %v", n.IP, mac, i.HardwareAddr)
+			}
+			return
+		}
+	}
+	t.Skip("no interface with a MAC")
+}
@@ -9,8 +9,6 @@ import (
 )
 
 func TestBroadcast(t *testing.T) {
-	broadcastLevel := ""
-	broadcastValue := ""
 	myLevel := "alarming!"
 	myLevelValue := "now!"
 
@@ -18,9 +16,9 @@ func TestBroadcast(t *testing.T) {
 	cleanMqtt(t)
 	d := createTestDevice()
 	createTestNode(d, "a-node")
+	broadcasts := make(chan [2]string, 1)
 	d.SetBroadcastHandler(func(d *Device, level, value string) {
-		broadcastLevel = level
-		broadcastValue = value
+		broadcasts <- [2]string{level, value}
 	})
 
 	// Run for until cancelled
@@ -30,17 +28,21 @@ func TestBroadcast(t *testing.T) {
 	time.Sleep(time.Duration(25) * time.Millisecond)
 
 	// send a broadcast
-	token := d.client.Publish(testTopicBase+"/$broadcast/"+myLevel, 1, true, myLevelValue)
+	token := testClient.Publish(testTopicBase+"/$broadcast/"+myLevel, 1, true, myLevelValue)
 	token.Wait()
 	if token.Error() != nil {
 		t.Errorf("broadcast failed with error: %v", token.Error())
 	}
-	time.Sleep(time.Duration(25) * time.Millisecond)
-	if broadcastLevel != myLevel {
-		t.Errorf("broadcast level mismatch.  Expected \"%s\" got \"%s\"", myLevel, broadcastLevel)
-	}
-	if broadcastValue != myLevelValue {
-		t.Errorf("broadcast value mismatch.  Expected \"%s\" got \"%s\"", myLevelValue, broadcastValue)
+	select {
+	case b := <-broadcasts:
+		if b[0] != myLevel {
+			t.Errorf("broadcast level mismatch.  Expected \"%s\" got \"%s\"", myLevel, b[0])
+		}
+		if b[1] != myLevelValue {
+			t.Errorf("broadcast value mismatch.  Expected \"%s\" got \"%s\"", myLevelValue, b[1])
+		}
+	case <-time.After(time.Second):
+		t.Errorf("broadcast was not delivered")
 	}
 
 	// terminate the run
@@ -0,0 +1,940 @@
+package homie
+
+//
+// This file contains the controller side of the convention.
+// A controller subscribes to a topic base, and reassembles the devices,
+// nodes, and properties it finds there from their retained attributes.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// These are the kinds of events a controller reports
+const (
+	EvDeviceAdded = iota
+	EvDeviceRemoved
+	EvStateChanged
+	EvValueChanged
+	EvNodeRemoved
+	EvPropertyRemoved
+)
+
+type ControllerEvent struct {
+	Type     int
+	Device   *ControllerDevice
+	Node     *ControllerNode     // EvNodeRemoved and EvPropertyRemoved only
+	Property *ControllerProperty // EvValueChanged and EvPropertyRemoved only
+	Value    string              // the new state or value
+}
+
+type Controller struct {
+	topicBase   string
+	protocol    int // HomieV4 or HomieV5
+	mqttBroker  string
+	mqttVersion int            // MqttV311 or MqttV5
+	security    brokerSecurity // credentials and TLS for the default transport
+	transport   Transport      // default is a PahoTransport for mqttBroker
+	connected   atomic.Bool
+	handler     func(c *Controller, e ControllerEvent)
+
+	// All of the tree below is guarded by mutex
+	mutex   sync.Mutex
+	devices map[string]*ControllerDevice
+}
+
+type ControllerDevice struct {
+	controller *Controller
+	id         string
+	announced  bool              // true once $homie (v4) or $description (v5) is seen
+	state      string            // last $state seen
+	attributes map[string]string // every device attribute seen, e.g. "$name", "$stats/uptime"
+	nodes      map[string]*ControllerNode
+}
+
+type ControllerNode struct {
+	device     *ControllerDevice
+	id         string
+	name       string
+	nType      string
+	array      string // "lo-hi" for v4 spans
+	properties map[string]*ControllerProperty
+}
+
+type ControllerProperty struct {
+	node     *ControllerNode
+	spec     Property // used to check values, using the same rules as the device side
+	retained bool
+	value    string
+	waiters  map[chan bool]bool // Set() calls waiting for the value to change
+}
+
+var controllerCounter atomic.Int64
+
+// Create a controller for the devices under a topic base.
+func NewController(topicBase string) *Controller {
+	var c Controller
+
+	c.topicBase = validate(topicBase, false)
+	c.protocol = HomieV4
+	c.mqttBroker = defaultMqttBroker
+	c.mqttVersion = MqttV311
+	c.devices = make(map[string]*ControllerDevice)
+
+	return &c
+}
+
+func (c *Controller) SetMqttBroker(broker string) {
+	if c.connected.Load() {
+		panic("Cannot set mqtt broker on connected controller")
+	}
+	c.mqttBroker = broker
+}
+
+// Choose the convention the controller looks for, HomieV4 or HomieV5.  The default is HomieV4.
+func (c *Controller) SetProtocol(protocol int) {
+	if c.connected.Load() {
+		panic("Cannot set protocol on connected controller")
+	}
+	if protocol != HomieV4 && protocol != HomieV5 {
+		panic("Invalid protocol for controller")
+	}
+	c.protocol = protocol
+}
+
+// Use a transport other than the default paho client.
+// The broker set with SetMqttBroker() is not used.
+func (c *Controller) SetTransport(t Transport) {
+	if c.connected.Load() {
+		panic("Cannot set transport on connected controller")
+	}
+	c.transport = t
+}
+
+// The handler is called out of the mqtt message handler.  It must not block.
+func (c *Controller) SetEventHandler(handler func(c *Controller, e ControllerEvent)) {
+	c.mutex.Lock()
+	c.handler = handler
+	c.mutex.Unlock()
+}
+
+// The root of the topics this controller watches
+func (c *Controller) root() string {
+	if c.protocol == HomieV5 {
+		return c.topicBase + "/5/"
+	}
+	return c.topicBase + "/"
+}
+
+// Connect to the broker and start watching.
+// Blocks until the subscription is acknowledged, or the timeout expires.
+func (c *Controller) Connect(timeout time.Duration) error {
+	if c.transport == nil {
+		clientID := fmt.Sprintf("%s-controller-%d-%d", mqttClientIDPrefix, os.Getpid(), controllerCounter.Add(1))
+		if c.mqttVersion == MqttV5 {
+			t := NewPahoV5Transport(c.mqttBroker, clientID)
+			c.security.applyV5(t)
+			c.transport = t
+		} else {
+			t := NewPahoTransport(c.mqttBroker, clientID)
+			c.security.apply(t)
+			c.transport = t
+		}
+	}
+
+	// The first subscription's token, for Connect to wait on
+	subscribed := make(chan Token, 1)
+
+	deadline := time.Now().Add(timeout)
+	token := c.transport.Connect(nil,
+		func() {
+			// (re)subscribe.  The broker sends all of the retained attributes again.
+			t := c.transport.Subscribe(c.root()+"#", 1, func(topic string, payload []byte) {
+				c.processMessage(topic, string(payload))
+			})
+			select {
+			case subscribed <- t:
+			default:
+			}
+		},
+		func(err error) {})
+	if !token.WaitTimeout(timeout) {
+		c.transport.Disconnect(0) // stop it trying
+		return fmt.Errorf("timed out connecting to %s", c.mqttBroker)
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+
+	var err error
+	select {
+	case t := <-subscribed:
+		if !t.WaitTimeout(time.Until(deadline)) {
+			err = fmt.Errorf("timed out subscribing to %s#", c.root())
+		} else {
+			err = t.Error()
+		}
+	case <-time.After(time.Until(deadline)):
+		err = fmt.Errorf("timed out subscribing to %s#", c.root())
+	}
+	if err != nil {
+		c.transport.Disconnect(0)
+		return err
+	}
+	c.connected.Store(true)
+	return nil
+}
+
+func (c *Controller) Disconnect() {
+	if c.connected.CompareAndSwap(true, false) {
+		c.transport.Disconnect(150 * time.Millisecond)
+	}
+}
+
+// Returns the devices that have announced themselves, sorted by ID.
+func (c *Controller) Devices() []*ControllerDevice {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r := make([]*ControllerDevice, 0, len(c.devices))
+	for _, d := range c.devices {
+		if d.announced {
+			r = append(r, d)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].id < r[j].id })
+	return r
+}
+
+// Returns the device, or nil if it has not announced itself.
+func (c *Controller) Device(id string) *ControllerDevice {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if d, ok := c.devices[id]; ok && d.announced {
+		return d
+	}
+	return nil
+}
+
+// Returns true if id is a valid Homie ID, using the same rules as the device side.
+func isValidId(id string) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return validate(id, false) == id
+}
+
+func isValidIndex(index string) bool {
+	if len(index) == 0 {
+		return false
+	}
+	for _, b := range []byte(index) {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Called for each message under the topic root.
+// Events are collected while the tree is locked, and reported after it is unlocked.
+func (c *Controller) processMessage(topic, payload string) {
+	var events []ControllerEvent
+
+	levels := strings.Split(strings.TrimPrefix(topic, c.root()), "/")
+	if !isValidId(levels[0]) {
+		// $broadcast, or something that is not a device
+		return
+	}
+
+	c.mutex.Lock()
+	d, ok := c.devices[levels[0]]
+	if !ok {
+		d = &ControllerDevice{
+			controller: c,
+			id:         levels[0],
+			attributes: make(map[string]string),
+			nodes:      make(map[string]*ControllerNode),
+		}
+		c.devices[d.id] = d
+	}
+
+	if c.protocol == HomieV5 {
+		events = d.processMessageV5(levels[1:], payload)
+	} else {
+		events = d.processMessageV4(levels[1:], payload)
+	}
+	handler := c.handler
+	c.mutex.Unlock()
+
+	if handler != nil {
+		for _, e := range events {
+			handler(c, e)
+		}
+	}
+}
+
+// Handle the device attributes common to both conventions.
+// Returns true if the attribute was handled.
+func (d *ControllerDevice) processDeviceAttribute(attribute, payload string, events *[]ControllerEvent) bool {
+	c := d.controller
+
+	switch attribute {
+	case "$state":
+		if payload != d.state {
+			d.state = payload
+			if d.announced {
+				*events = append(*events, ControllerEvent{Type: EvStateChanged, Device: d, Value: payload})
+			}
+		}
+		return true
+	case "$homie", "$description":
+		if len(payload) == 0 {
+			// retained attribute cleared.  The device is gone.
+			delete(c.devices, d.id)
+			if d.announced {
+				*events = append(*events, ControllerEvent{Type: EvDeviceRemoved, Device: d})
+			}
+			return true
+		}
+		if !d.announced {
+			d.announced = true
+			*events = append(*events, ControllerEvent{Type: EvDeviceAdded, Device: d})
+		}
+	}
+	return false
+}
+
+func (d *ControllerDevice) processMessageV4(levels []string, payload string) []ControllerEvent {
+	var events []ControllerEvent
+
+	if len(levels) == 0 {
+		return nil
+	}
+
+	// Device attributes, including the multi level ones like $stats/uptime
+	if strings.HasPrefix(levels[0], "$") {
+		attribute := strings.Join(levels, "/")
+		if d.processDeviceAttribute(attribute, payload, &events) {
+			return events
+		}
+		d.attributes[attribute] = payload
+		if attribute == "$nodes" && len(payload) > 0 {
+			d.reconcileNodesV4(payload, &events)
+		}
+		return events
+	}
+
+	// An empty payload clears a retained topic, often one of a node or property
+	// that was just taken away, so it must not bring that node or property back.
+	n, ok := d.nodes[levels[0]]
+	if !ok && len(payload) > 0 {
+		n = d.node(levels[0])
+	}
+	if n == nil || len(levels) < 2 {
+		return events
+	}
+
+	// Node attributes
+	switch levels[1] {
+	case "$name":
+		n.name = payload
+		return events
+	case "$type":
+		n.nType = payload
+		return events
+	case "$array":
+		n.array = payload
+		return events
+	case "$properties":
+		if len(payload) > 0 {
+			n.reconcilePropertiesV4(payload, &events)
+		}
+		return events
+	}
+
+	p, ok := n.properties[levels[1]]
+	if !ok && len(payload) > 0 {
+		p = n.property(levels[1])
+	}
+	if p == nil {
+		return events
+	}
+
+	// Property value
+	if len(levels) == 2 {
+		if payload != p.value {
+			p.setValue(payload)
+			events = append(events, ControllerEvent{Type: EvValueChanged, Device: d, Property: p, Value: payload})
+		}
+		return events
+	}
+
+	// Property attributes
+	switch levels[2] {
+	case "$name":
+		p.spec.name = payload
+	case "$datatype":
+		p.spec.dataType, _ = dataTypeFromName(payload)
+		p.setFormat(p.spec.format)
+	case "$format":
+		p.setFormat(payload)
+	case "$unit":
+		p.spec.unit = payload
+	case "$settable":
+		p.spec.settable = payload == "true"
+	case "$retained":
+		p.retained = payload != "false"
+	default:
+		return events
+	}
+
+	// The indexes of a span share the attributes published under its base node
+	for id, index := range d.nodes {
+		if base, _, isIndex := strings.Cut(id, "_"); isIndex && base == n.id {
+			if ip, ok := index.properties[p.spec.id]; ok {
+				ip.inherit(p)
+			}
+		}
+	}
+	return events
+}
+
+func (d *ControllerDevice) processMessageV5(levels []string, payload string) []ControllerEvent {
+	var (
+		events []ControllerEvent
+		desc   descriptionV5
+	)
+
+	if len(levels) == 0 {
+		return nil
+	}
+
+	if strings.HasPrefix(levels[0], "$") {
+		attribute := strings.Join(levels, "/")
+		if len(payload) > 0 && attribute == "$description" && json.Unmarshal([]byte(payload), &desc) != nil {
+			// not a description we can use
+			return nil
+		}
+		if d.processDeviceAttribute(attribute, payload, &events) {
+			return events
+		}
+		d.attributes[attribute] = payload
+		if attribute == "$description" {
+			d.attributes["$name"] = desc.Name
+			d.attributes["$homie"] = desc.Homie
+			d.applyDescriptionV5(desc, &events)
+		}
+		return events
+	}
+
+	// Property value
+	if len(levels) == 2 {
+		if n, ok := d.nodes[levels[0]]; ok {
+			if p, ok := n.properties[levels[1]]; ok {
+				if value, ok := p.spec.valueFromV5(payload); ok && value != p.value {
+					p.setValue(value)
+					events = append(events, ControllerEvent{Type: EvValueChanged, Device: d, Property: p, Value: value})
+				}
+			}
+		}
+	}
+	return events
+}
+
+// Bring the nodes in line with a v4 $nodes list.  Nodes that are no longer
+// listed are removed, except the indexes of a listed span.
+func (d *ControllerDevice) reconcileNodesV4(payload string, events *[]ControllerEvent) {
+	listed := make(map[string]bool)
+	for _, id := range strings.Split(payload, ",") {
+		listed[id] = true
+		d.node(strings.TrimSuffix(id, "[]"))
+	}
+
+	for _, id := range sortedKeys(d.nodes) {
+		base, _, isIndex := strings.Cut(id, "_")
+		if listed[id] || listed[id+"[]"] || (isIndex && listed[base+"[]"]) {
+			continue
+		}
+		n := d.nodes[id]
+		delete(d.nodes, id)
+		if d.announced {
+			*events = append(*events, ControllerEvent{Type: EvNodeRemoved, Device: d, Node: n})
+		}
+	}
+}
+
+// Bring the properties in line with a v4 $properties list.  The indexes
+// of a span publish no list of their own, so they follow their base node.
+func (n *ControllerNode) reconcilePropertiesV4(payload string, events *[]ControllerEvent) {
+	d := n.device
+	listed := make(map[string]bool)
+	for _, id := range strings.Split(payload, ",") {
+		listed[id] = true
+		n.property(id)
+	}
+
+	for _, nodeId := range sortedKeys(d.nodes) {
+		base, _, isIndex := strings.Cut(nodeId, "_")
+		if nodeId != n.id && (!isIndex || base != n.id) {
+			continue
+		}
+		node := d.nodes[nodeId]
+		for _, id := range sortedKeys(node.properties) {
+			if listed[id] {
+				continue
+			}
+			p := node.properties[id]
+			delete(node.properties, id)
+			if d.announced {
+				*events = append(*events, ControllerEvent{Type: EvPropertyRemoved, Device: d, Node: node, Property: p})
+			}
+		}
+	}
+}
+
+// Rebuild the nodes and properties from a v5 description.  Values are kept.
+// Nodes and properties that are no longer described are reported as removed.
+func (d *ControllerDevice) applyDescriptionV5(desc descriptionV5, events *[]ControllerEvent) {
+	nodes := d.nodes
+	d.nodes = make(map[string]*ControllerNode)
+
+	for nodeId, nd := range desc.Nodes {
+		n := d.node(nodeId)
+		if n == nil {
+			continue
+		}
+		n.name = nd.Name
+		n.nType = nd.Type
+		for propertyId, pd := range nd.Properties {
+			p := n.property(propertyId)
+			if p == nil {
+				continue
+			}
+			if old, ok := nodes[nodeId]; ok {
+				if oldP, ok := old.properties[propertyId]; ok {
+					p.value = oldP.value
+				}
+			}
+			p.spec.name = pd.Name
+			p.spec.dataType, _ = dataTypeFromName(pd.Datatype)
+			p.spec.unit = pd.Unit
+			p.spec.settable = pd.Settable
+			p.retained = pd.Retained == nil || *pd.Retained
+			p.setFormat(pd.Format)
+		}
+	}
+
+	for _, id := range sortedKeys(nodes) {
+		old := nodes[id]
+		n, ok := d.nodes[id]
+		if !ok {
+			*events = append(*events, ControllerEvent{Type: EvNodeRemoved, Device: d, Node: old})
+			continue
+		}
+		for _, propertyId := range sortedKeys(old.properties) {
+			if _, ok := n.properties[propertyId]; !ok {
+				*events = append(*events, ControllerEvent{Type: EvPropertyRemoved, Device: d, Node: n, Property: old.properties[propertyId]})
+			}
+		}
+	}
+}
+
+// The keys of a map in order, so that events come out the same way every time.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Find or create a node.  Returns nil if the ID is not valid.
+// IDs like relay_3, used for one index of a v4 span, are valid here.
+func (d *ControllerDevice) node(id string) *ControllerNode {
+	if n, ok := d.nodes[id]; ok {
+		return n
+	}
+	base, index, isIndex := strings.Cut(id, "_")
+	if !isValidId(base) || (isIndex && !isValidIndex(index)) {
+		return nil
+	}
+
+	n := &ControllerNode{device: d, id: id, properties: make(map[string]*ControllerProperty)}
+	d.nodes[id] = n
+	return n
+}
+
+// Find or create a property.  Returns nil if the ID is not valid.
+func (n *ControllerNode) property(id string) *ControllerProperty {
+	if p, ok := n.properties[id]; ok {
+		return p
+	}
+	if !isValidId(id) {
+		return nil
+	}
+
+	p := &ControllerProperty{node: n, retained: true, waiters: make(map[chan bool]bool)}
+	p.spec.id = id
+	p.spec.node = &Node{id: n.id}
+	n.properties[id] = p
+
+	// A property of one index of a v4 span takes its attributes from the span
+	if base, _, isIndex := strings.Cut(n.id, "_"); isIndex {
+		if b, ok := n.device.nodes[base]; ok {
+			if bp, ok := b.properties[id]; ok {
+				p.inherit(bp)
+			}
+		}
+	}
+	return p
+}
+
+// Copy the attributes of a span property to the same property of one of its indexes.
+func (p *ControllerProperty) inherit(from *ControllerProperty) {
+	p.spec.name = from.spec.name
+	p.spec.dataType = from.spec.dataType
+	p.spec.unit = from.spec.unit
+	p.spec.settable = from.spec.settable
+	p.retained = from.retained
+	p.setFormat(from.spec.format)
+}
+
+// Record a new value and wake up anybody waiting for it.  Called with the tree locked.
+func (p *ControllerProperty) setValue(value string) {
+	p.value = value
+	for w := range p.waiters {
+		select {
+		case w <- true:
+		default:
+		}
+	}
+}
+
+// Record a format.  A format that does not parse is kept, but does not restrict values.
+func (p *ControllerProperty) setFormat(format string) {
+	p.spec.format = format
+	p.spec.parsedFormat = PropertyFormat{}
+	if len(format) == 0 {
+		return
+	}
+	defer func() {
+		recover()
+	}()
+	p.spec.parsedFormat = p.spec.parseFormat(format)
+}
+
+// Device accessors
+
+func (d *ControllerDevice) Id() string {
+	return d.id
+}
+
+func (d *ControllerDevice) Name() string {
+	return d.Attribute("$name")
+}
+
+func (d *ControllerDevice) State() string {
+	d.controller.mutex.Lock()
+	defer d.controller.mutex.Unlock()
+	return d.state
+}
+
+// Returns a device attribute, e.g. "$homie" or "$stats/uptime", or "" if it has not been seen.
+func (d *ControllerDevice) Attribute(attribute string) string {
+	d.controller.mutex.Lock()
+	defer d.controller.mutex.Unlock()
+	return d.attributes[attribute]
+}
+
+// Returns the device's nodes, sorted by ID.
+func (d *ControllerDevice) Nodes() []*ControllerNode {
+	d.controller.mutex.Lock()
+	defer d.controller.mutex.Unlock()
+
+	r := make([]*ControllerNode, 0, len(d.nodes))
+	for _, n := range d.nodes {
+		r = append(r, n)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].id < r[j].id })
+	return r
+}
+
+// Returns the node, or nil if there is no such node.
+func (d *ControllerDevice) Node(id string) *ControllerNode {
+	d.controller.mutex.Lock()
+	defer d.controller.mutex.Unlock()
+	return d.nodes[id]
+}
+
+// Node accessors
+
+func (n *ControllerNode) Device() *ControllerDevice {
+	return n.device
+}
+
+func (n *ControllerNode) Id() string {
+	return n.id
+}
+
+func (n *ControllerNode) Name() string {
+	n.device.controller.mutex.Lock()
+	defer n.device.controller.mutex.Unlock()
+	return n.name
+}
+
+func (n *ControllerNode) NodeType() string {
+	n.device.controller.mutex.Lock()
+	defer n.device.controller.mutex.Unlock()
+	return n.nType
+}
+
+// Returns the node's properties, sorted by ID.
+func (n *ControllerNode) Properties() []*ControllerProperty {
+	n.device.controller.mutex.Lock()
+	defer n.device.controller.mutex.Unlock()
+
+	r := make([]*ControllerProperty, 0, len(n.properties))
+	for _, p := range n.properties {
+		r = append(r, p)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].spec.id < r[j].spec.id })
+	return r
+}
+
+// Returns the property, or nil if there is no such property.
+func (n *ControllerNode) Property(id string) *ControllerProperty {
+	n.device.controller.mutex.Lock()
+	defer n.device.controller.mutex.Unlock()
+	return n.properties[id]
+}
+
+// Returns true if the node is a v4 span.  Its indexes are nodes of their own, e.g. relay_1.
+func (n *ControllerNode) IsSpan() bool {
+	n.device.controller.mutex.Lock()
+	defer n.device.controller.mutex.Unlock()
+	return len(n.array) > 0
+}
+
+// The index range from a v4 span's $array.  Called with the tree locked.
+func (n *ControllerNode) arrayRange() (lo, hi int, ok bool) {
+	l, h, found := strings.Cut(n.array, "-")
+	lo, err1 := strconv.Atoi(l)
+	hi, err2 := strconv.Atoi(h)
+	return lo, hi, found && err1 == nil && err2 == nil
+}
+
+// Property accessors
+
+func (p *ControllerProperty) Node() *ControllerNode {
+	return p.node
+}
+
+func (p *ControllerProperty) Id() string {
+	return p.spec.id
+}
+
+func (p *ControllerProperty) Name() string {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.spec.name
+}
+
+// Returns one of the Dt data type constants
+func (p *ControllerProperty) DataType() int {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.spec.dataType
+}
+
+func (p *ControllerProperty) Format() string {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.spec.format
+}
+
+func (p *ControllerProperty) ParsedFormat() PropertyFormat {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.spec.parsedFormat
+}
+
+func (p *ControllerProperty) Unit() string {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.spec.unit
+}
+
+func (p *ControllerProperty) Settable() bool {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.spec.settable
+}
+
+func (p *ControllerProperty) Retained() bool {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.retained
+}
+
+// Returns the last value seen
+func (p *ControllerProperty) Value() string {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.value
+}
+
+// Returns nil if the value is legal for the property, using the same rules as the device side.
+func (p *ControllerProperty) CheckValue(value string) error {
+	p.node.device.controller.mutex.Lock()
+	defer p.node.device.controller.mutex.Unlock()
+	return p.spec.checkValue(value)
+}
+
+// Set a property on a device, and wait for the device to confirm it
+// by publishing the new value.  The node may be one index of a v4 span, e.g. relay_3.
+func (c *Controller) Set(ctx context.Context, deviceId, nodeId, propertyId, value string) error {
+	d := c.Device(deviceId)
+	if d == nil {
+		return fmt.Errorf("no device %s", deviceId)
+	}
+	if base, index, isIndex := strings.Cut(nodeId, "_"); isIndex && isValidIndex(index) {
+		if n := d.Node(base); n != nil && n.IsSpan() {
+			p := n.Property(propertyId)
+			if p == nil {
+				return fmt.Errorf("span %s in device %s has no property %s", base, deviceId, propertyId)
+			}
+			i, _ := strconv.Atoi(index)
+			return p.SetIndex(ctx, i, value)
+		}
+	}
+	n := d.Node(nodeId)
+	if n == nil {
+		return fmt.Errorf("device %s has no node %s", deviceId, nodeId)
+	}
+	p := n.Property(propertyId)
+	if p == nil {
+		return fmt.Errorf("node %s in device %s has no property %s", nodeId, deviceId, propertyId)
+	}
+	return p.Set(ctx, value)
+}
+
+// Publish a set message for the property, then wait until the device
+// publishes the new value, or until the context is done.
+// Returns an error without publishing if the value is not legal for the property.
+func (p *ControllerProperty) Set(ctx context.Context, value string) error {
+	n := p.node
+	d := n.device
+	c := d.controller
+
+	if !c.connected.Load() {
+		return fmt.Errorf("controller is not connected")
+	}
+	if n.IsSpan() {
+		return fmt.Errorf("property %s in span %s of device %s is set one index at a time", p.spec.id, n.id, d.id)
+	}
+	if !p.Settable() {
+		return fmt.Errorf("property %s in node %s of device %s is not settable", p.spec.id, n.id, d.id)
+	}
+	if err := p.CheckValue(value); err != nil {
+		return err
+	}
+
+	changed := make(chan bool, 1)
+	c.mutex.Lock()
+	p.waiters[changed] = true
+	current := p.value
+	payload := value
+	if c.protocol == HomieV5 {
+		payload = p.spec.valueV5(value)
+	}
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(p.waiters, changed)
+		c.mutex.Unlock()
+	}()
+
+	token := c.transport.Publish(c.root()+d.id+"/"+n.id+"/"+p.spec.id+"/set", 1, false, payload)
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("set of %s/%s/%s not sent: %w", d.id, n.id, p.spec.id, ctx.Err())
+	}
+
+	// A device need not republish a value that did not change
+	if p.sameValue(current, value) {
+		return nil
+	}
+
+	for {
+		select {
+		case <-changed:
+			if p.sameValue(p.Value(), value) {
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("set of %s/%s/%s to \"%s\" not confirmed: %w", d.id, n.id, p.spec.id, value, ctx.Err())
+		}
+	}
+}
+
+// Set one index of a property of a v4 span, and wait for the device to confirm it.
+// The device takes sets, and publishes values, for each index, e.g. relay_3/on.
+func (p *ControllerProperty) SetIndex(ctx context.Context, index int, value string) error {
+	n := p.node
+	d := n.device
+	c := d.controller
+
+	c.mutex.Lock()
+	var ip *ControllerProperty
+	lo, hi, ok := n.arrayRange()
+	if ok && index >= lo && index <= hi {
+		if in := d.node(n.id + "_" + strconv.Itoa(index)); in != nil {
+			ip = in.property(p.spec.id)
+		}
+	}
+	c.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("node %s of device %s is not a span", n.id, d.id)
+	}
+	if ip == nil {
+		return fmt.Errorf("index %d is out of range %d-%d for span %s of device %s", index, lo, hi, n.id, d.id)
+	}
+	return ip.Set(ctx, value)
+}
+
+// Compares two values of the property.  Numbers are compared by value, so "1.50" and "1.5" are the same.
+func (p *ControllerProperty) sameValue(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	switch p.DataType() {
+	case DtInteger, DtFloat:
+		x, err1 := strconv.ParseFloat(a, 64)
+		y, err2 := strconv.ParseFloat(b, 64)
+		return err1 == nil && err2 == nil && x == y
+	case DtColor:
+		return parseColor(a) == parseColor(b)
+	}
+	return false
+}
@@ -0,0 +1,357 @@
+package homie
+
+// test the controller's reassembly of devices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func feedController(c *Controller, messages [][2]string) {
+	for _, m := range messages {
+		c.processMessage(m[0], m[1])
+	}
+}
+
+func TestController_V4(t *testing.T) {
+	var events []ControllerEvent
+
+	c := NewController("testing")
+	c.SetEventHandler(func(c *Controller, e ControllerEvent) {
+		events = append(events, e)
+	})
+
+	feedController(c, [][2]string{
+		{"testing/$broadcast/alert", "now"},
+		{"testing/dev-a/$state", "init"},
+		{"testing/dev-a/$homie", "4.0.0"},
+		{"testing/dev-a/$name", "Device A"},
+		{"testing/dev-a/$stats/uptime", "12"},
+		{"testing/dev-a/$nodes", "outlet,relay[]"},
+		{"testing/dev-a/outlet/$name", "Outlet"},
+		{"testing/dev-a/outlet/$type", "relay"},
+		{"testing/dev-a/outlet/$properties", "power"},
+		{"testing/dev-a/outlet/power/$format", "0:100"},
+		{"testing/dev-a/outlet/power/$datatype", "integer"},
+		{"testing/dev-a/outlet/power/$settable", "true"},
+		{"testing/dev-a/outlet/power/$unit", "W"},
+		{"testing/dev-a/outlet/power", "40"},
+		{"testing/dev-a/outlet/power/set", "50"},
+		{"testing/dev-a/relay/$array", "1-2"},
+		{"testing/dev-a/relay_2/$name", "Relay 2"},
+		{"testing/dev-a/relay_x/$name", "Relay x"},
+		{"testing/dev-a/$state", "ready"},
+	})
+
+	d := c.Device("dev-a")
+	if d == nil {
+		t.Fatalf("device dev-a not found")
+	}
+	if d.Name() != "Device A" || d.State() != "ready" || d.Attribute("$stats/uptime") != "12" {
+		t.Errorf("device attributes are wrong: %s %s %s", d.Name(), d.State(), d.Attribute("$stats/uptime"))
+	}
+	if nodes := d.Nodes(); len(nodes) != 3 || nodes[0].Id() != "outlet" || nodes[1].Id() != "relay" {
+		t.Errorf("device has nodes %v", nodes)
+	}
+	if n := d.Node("relay_2"); n == nil || n.Name() != "Relay 2" {
+		t.Errorf("span index relay_2 not found")
+	}
+
+	p := d.Node("outlet").Property("power")
+	if p.DataType() != DtInteger || !p.Settable() || p.Unit() != "W" || p.Value() != "40" || !p.ParsedFormat().HasMax {
+		t.Errorf("property is wrong: %+v", p.spec)
+	}
+	if p.CheckValue("101") == nil || p.CheckValue("99") != nil {
+		t.Errorf("property format is not applied")
+	}
+
+	expected := []int{EvDeviceAdded, EvValueChanged, EvStateChanged}
+	if len(events) != len(expected) {
+		t.Fatalf("saw %d events, expected %d", len(events), len(expected))
+	}
+	for i, e := range events {
+		if e.Type != expected[i] {
+			t.Errorf("event %d has type %d, expected %d", i, e.Type, expected[i])
+		}
+	}
+
+	// Clearing $homie removes the device
+	events = nil
+	c.processMessage("testing/dev-a/$homie", "")
+	if c.Device("dev-a") != nil || len(c.Devices()) != 0 {
+		t.Errorf("device dev-a not removed")
+	}
+	if len(events) != 1 || events[0].Type != EvDeviceRemoved {
+		t.Errorf("saw events %v on removal", events)
+	}
+}
+
+// A republished $nodes or $properties takes away what it no longer lists
+func TestController_V4Reconcile(t *testing.T) {
+	var events []ControllerEvent
+
+	c := NewController("testing")
+	c.SetEventHandler(func(c *Controller, e ControllerEvent) {
+		events = append(events, e)
+	})
+
+	feedController(c, [][2]string{
+		{"testing/dev-a/$homie", "4.0.0"},
+		{"testing/dev-a/$nodes", "outlet,lamp,relay[]"},
+		{"testing/dev-a/outlet/$properties", "power,energy"},
+		{"testing/dev-a/outlet/power", "40"},
+		{"testing/dev-a/outlet/energy", "7"},
+		{"testing/dev-a/lamp/$properties", "on"},
+		{"testing/dev-a/relay/$array", "1-2"},
+		{"testing/dev-a/relay/$properties", "on,fault"},
+		{"testing/dev-a/relay_1/on", "true"},
+		{"testing/dev-a/relay_1/fault", "false"},
+		{"testing/dev-a/$state", "ready"},
+	})
+	events = nil
+
+	// The device takes away the lamp and the energy and fault properties,
+	// and clears their retained topics
+	feedController(c, [][2]string{
+		{"testing/dev-a/$nodes", "outlet,relay[]"},
+		{"testing/dev-a/outlet/$properties", "power"},
+		{"testing/dev-a/relay/$properties", "on"},
+		{"testing/dev-a/lamp/$properties", ""},
+		{"testing/dev-a/lamp/on", ""},
+		{"testing/dev-a/outlet/energy", ""},
+		{"testing/dev-a/relay_1/fault", ""},
+	})
+
+	d := c.Device("dev-a")
+	if nodes := d.Nodes(); len(nodes) != 3 || d.Node("lamp") != nil || d.Node("relay_1") == nil {
+		t.Errorf("device has nodes %v", nodes)
+	}
+	if d.Node("outlet").Property("energy") != nil || d.Node("outlet").Property("power") == nil {
+		t.Errorf("outlet has properties %v", d.Node("outlet").Properties())
+	}
+	if d.Node("relay").Property("fault") != nil || d.Node("relay_1").Property("fault") != nil {
+		t.Errorf("span index kept property fault")
+	}
+
+	expected := []struct {
+		kind     int
+		node     string
+		property string
+	}{
+		{EvNodeRemoved, "lamp", ""},
+		{EvPropertyRemoved, "outlet", "energy"},
+		{EvPropertyRemoved, "relay", "fault"},
+		{EvPropertyRemoved, "relay_1", "fault"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("saw %d events, expected %d", len(events), len(expected))
+	}
+	for i, e := range events {
+		property := ""
+		if e.Property != nil {
+			property = e.Property.Id()
+		}
+		if e.Type != expected[i].kind || e.Node.Id() != expected[i].node || property != expected[i].property {
+			t.Errorf("event %d is %d %s %s, expected %v", i, e.Type, e.Node.Id(), property, expected[i])
+		}
+	}
+}
+
+func TestController_V5(t *testing.T) {
+	var values []string
+
+	d := createTestDevice()
+	d.SetProtocols(HomieV5)
+	n := d.NewNode("light", "Light", "test", nil)
+	n.Advertise("color", "Color", DtColor).SetFormat("rgb")
+
+	c := NewController("testing")
+	c.SetProtocol(HomieV5)
+	c.SetEventHandler(func(c *Controller, e ControllerEvent) {
+		if e.Type == EvValueChanged {
+			values = append(values, e.Value)
+		}
+	})
+
+	feedController(c, [][2]string{
+		{"testing/5/" + d.id + "/$state", "ready"},
+		{"testing/5/" + d.id + "/$description", string(d.descriptionV5())},
+		{"testing/5/" + d.id + "/light/color", "rgb,1,2,3"},
+	})
+
+	cd := c.Device(d.id)
+	if cd == nil {
+		t.Fatalf("device %s not found", d.id)
+	}
+	if cd.Name() != "Test Device 0" || cd.State() != "ready" {
+		t.Errorf("device attributes are wrong: %s %s", cd.Name(), cd.State())
+	}
+	p := cd.Node("light").Property("color")
+	if p == nil || p.DataType() != DtColor || p.Value() != "1,2,3" {
+		t.Fatalf("property is wrong")
+	}
+	if len(values) != 1 || values[0] != "1,2,3" {
+		t.Errorf("saw values %v", values)
+	}
+
+	// A new description keeps the values
+	c.processMessage("testing/5/"+d.id+"/$description", string(d.descriptionV5()))
+	if p := cd.Node("light").Property("color"); p.Value() != "1,2,3" {
+		t.Errorf("value lost on new description")
+	}
+
+	// A description without the light takes it away
+	values = nil
+	var removed []ControllerEvent
+	c.SetEventHandler(func(c *Controller, e ControllerEvent) {
+		removed = append(removed, e)
+	})
+	d.RemoveNode("light")
+	c.processMessage("testing/5/"+d.id+"/$description", string(d.descriptionV5()))
+	if cd.Node("light") != nil {
+		t.Errorf("node light not removed")
+	}
+	if len(removed) != 1 || removed[0].Type != EvNodeRemoved || removed[0].Node.Id() != "light" {
+		t.Errorf("saw events %v on removal", removed)
+	}
+}
+
+func TestController_Set(t *testing.T) {
+	var published []string
+
+	c := NewController("testing")
+	feedController(c, [][2]string{
+		{"testing/dev-a/$homie", "4.0.0"},
+		{"testing/dev-a/outlet/power/$datatype", "float"},
+		{"testing/dev-a/outlet/power/$settable", "true"},
+		{"testing/dev-a/outlet/power", "40"},
+		{"testing/dev-a/outlet/name/$datatype", "string"},
+		{"testing/dev-a/outlet/name", "a name"},
+	})
+
+	// The device echoes every set after a short delay
+	echo := true
+	c.transport = newFakeTransport()
+	c.connected.Store(true)
+	c.transport.(*fakeTransport).publishHook = func(topic, payload string) {
+		published = append(published, topic+" "+payload)
+		if echo {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				c.processMessage(strings.TrimSuffix(topic, "/set"), payload+"0")
+			}()
+		}
+	}
+
+	ctx, cfl := context.WithTimeout(context.Background(), time.Second)
+	defer cfl()
+
+	if err := c.Set(ctx, "dev-a", "outlet", "power", "55.5"); err != nil {
+		t.Errorf("confirmed set failed: %v", err)
+	}
+	if len(published) != 1 || published[0] != "testing/dev-a/outlet/power/set 55.5" {
+		t.Errorf("published %v", published)
+	}
+
+	if err := c.Set(ctx, "dev-a", "outlet", "power", "lots"); err == nil {
+		t.Errorf("set of an invalid value did not fail")
+	}
+	if err := c.Set(ctx, "dev-a", "outlet", "name", "new name"); err == nil {
+		t.Errorf("set of a property that is not settable did not fail")
+	}
+	if err := c.Set(ctx, "dev-a", "outlet", "voltage", "1"); err == nil {
+		t.Errorf("set of an unknown property did not fail")
+	}
+
+	// No echo means no confirmation
+	echo = false
+	ctx2, cfl2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cfl2()
+	if err := c.Set(ctx2, "dev-a", "outlet", "power", "60"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unconfirmed set returned %v", err)
+	}
+}
+
+// Sets for a span go to one index, and are confirmed by that index
+func TestController_Span(t *testing.T) {
+	sets := make(chan string, 10)
+
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	n := d.NewSpan("relay", "Relay", "relay", 1, 2,
+		func(d *Device, n *Node, index int, p *Property, value string) bool {
+			sets <- fmt.Sprintf("%d %s", index, value)
+			p.SetSpanProperty(index).Send(value)
+			return true
+		})
+	n.Advertise("on", "On", DtBoolean).Settable(nil)
+	runTestDevice(t, d, f)
+
+	c := NewController(testTopicBase)
+	c.SetTransport(f)
+	if err := c.Connect(time.Second); err != nil {
+		t.Fatalf("controller Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+	waitFor(t, "the span", func() bool {
+		cd := c.Device(d.id)
+		return cd != nil && cd.Node("relay") != nil && cd.Node("relay").IsSpan() && cd.Node("relay_1") != nil
+	})
+
+	ctx, cfl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cfl()
+
+	if err := c.Set(ctx, d.id, "relay_1", "on", "true"); err != nil {
+		t.Errorf("set of index 1 failed: %v", err)
+	}
+	if p := c.Device(d.id).Node("relay_1").Property("on"); p == nil || p.DataType() != DtBoolean || !p.Settable() {
+		t.Errorf("index 1 did not take the attributes of the span")
+	}
+	span := c.Device(d.id).Node("relay").Property("on")
+	if err := span.SetIndex(ctx, 2, "true"); err != nil {
+		t.Errorf("set of index 2 failed: %v", err)
+	}
+	if err := span.SetIndex(ctx, 3, "true"); err == nil {
+		t.Errorf("set of index 3 did not fail")
+	}
+	if err := span.Set(ctx, "false"); err == nil {
+		t.Errorf("set without an index did not fail")
+	}
+	if err := c.Set(ctx, d.id, "relay_1", "on", "maybe"); err == nil {
+		t.Errorf("set of an invalid value did not fail")
+	}
+
+	close(sets)
+	var seen []string
+	for s := range sets {
+		seen = append(seen, s)
+	}
+	if strings.Join(seen, ",") != "1 true,2 true" {
+		t.Errorf("device saw sets %v", seen)
+	}
+}
+
+// Connects, but refuses subscriptions
+type refusingTransport struct {
+	*fakeTransport
+}
+
+func (r refusingTransport) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) Token {
+	return doneToken{err: &ReasonCodeError{Operation: "subscribe", Topic: topic, ReasonCode: 0x87, Reason: "not authorized"}}
+}
+
+func TestController_SubscribeRefused(t *testing.T) {
+	c := NewController("testing")
+	c.SetTransport(refusingTransport{newFakeTransport()})
+
+	err := c.Connect(time.Second)
+	var rc *ReasonCodeError
+	if !errors.As(err, &rc) || rc.ReasonCode != 0x87 {
+		t.Errorf("refused subscription returned %v", err)
+	}
+}
@@ -3,7 +3,7 @@ package homie
 import (
 	"context"
 	"fmt"
-	"github.com/eclipse/paho.mqtt.golang"
+	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -14,79 +14,165 @@ func NewDevice(id, name string) *Device {
 
 	id = validate(id, false)
 
-	if _, ok := devices[id]; ok {
-		panic("Duplicate device id: " + id)
-	}
-
 	device.id = id
-	device.configDone = false
 	device.protocol = "4.0.0"
+	device.protocols = HomieV4
 	device.name = name
 	device.state = "init"
 	device.implementation = "homieGo 0.1.0"
 	device.nodes = make(map[string]*Node)
+	device.retained = make(map[string]bool)
 
 	device.extensions = "org.homie.legacy-stats:0.1.1:[4.x],org.homie.legacy-firmware:0.1.1:[4.x]"
 	device.statsInterval = time.Duration(60) * time.Second
 	device.statsBootTime = time.Now()
+	device.statsProviders = defaultStatsProviders()
 	device.fwName = "unknown"
 	device.fwVersion = "unknown"
 	device.topicBase = defaultTopicBase
 
 	device.period = time.Second / time.Duration(4)
 
-	device.publishChannel = make(chan PropertyMessage, 100)
+	device.publishQueue = newPublishQueue()
 	device.connectChannel = make(chan bool, 16)
-	device.tokenChannel = make(chan *mqtt.Token, 256)
+	device.tokenChannel = make(chan Token, 256)
+	device.wakeChannel = make(chan struct{}, 1)
 	device.unsubscribes = make([]func(), 0, 10)
 	device.globalHandler = nil
 	device.broadcastHandler = nil
 
-	device.clientOptions = nil
 	device.mqttBroker = defaultMqttBroker
-	device.client = nil
+	device.mqttVersion = MqttV311
+	device.transport = nil
 
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+	if _, ok := devices[id]; ok {
+		panic("Duplicate device id: " + id)
+	}
 	devices[id] = &device
 
 	return &device
 }
 
 // to destroy a running device first cancel its context, then wait on its wait channel,
-// then call here
+// then call here.  Its retained topics stay on the broker unless SetPurgeOnExit() was called.
 func (d *Device) Destroy() {
-	if d.configDone {
+	if d.configDone.Load() {
 		panic("Cannot destroy running device " + d.id)
 	}
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
 	delete(devices, d.id)
 }
 
 func (d *Device) SetMqttBroker(broker string) {
-	if d.configDone {
+	if d.configDone.Load() {
 		panic("Cannot set mqtt broker on running device " + d.id)
 	}
 	d.mqttBroker = broker
 }
 
+// In strict mode, PropertyMessage.Send() refuses to publish values
+// that do not match the property's data type and format.
+func (d *Device) SetStrictValues(strict bool) {
+	d.strictValues.Store(strict)
+}
+
+// Choose the conventions the device is published under: HomieV4, HomieV5, or HomieV4|HomieV5.
+// The default is HomieV4.
+func (d *Device) SetProtocols(protocols int) {
+	if d.configDone.Load() {
+		panic("Cannot set protocols on running device " + d.id)
+	}
+	if protocols == 0 || protocols&^(HomieV4|HomieV5) != 0 {
+		panic("Invalid protocols for device " + d.id)
+	}
+	d.protocols = protocols
+}
+
+// Use a transport other than the default paho client.
+// The broker set with SetMqttBroker() is not used.
+func (d *Device) SetTransport(t Transport) {
+	if d.configDone.Load() {
+		panic("Cannot set transport on running device " + d.id)
+	}
+	d.transport = t
+}
+
 func (d *Device) SetGlobalHandler(handler func(d *Device, n *Node, p *Property, value string) bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
 	d.globalHandler = handler
 }
 
 func (d *Device) SetBroadcastHandler(handler func(d *Device, level, value string)) {
+	d.mutex.Lock()
 	d.broadcastHandler = handler
-	if d.connected {
+	d.mutex.Unlock()
+
+	if d.connected.Load() {
 		d.subscribeToBroadcasts()
 	}
 }
 
+func (d *Device) getBroadcastHandler() func(d *Device, level, value string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.broadcastHandler
+}
+
+// The error handler is told of errors that happen out of the device's
+// own go routines, such as a failure to connect to the broker.
+// Without one, these errors panic.
+func (d *Device) SetErrorHandler(handler func(d *Device, err error)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.errorHandler = handler
+}
+
+// Report an error that has no caller to return it to
+func (d *Device) reportError(err error) {
+	d.mutex.Lock()
+	handler := d.errorHandler
+	d.mutex.Unlock()
+
+	if handler == nil {
+		panic(err.Error())
+	}
+	handler(d, err)
+}
+
+// The loop is called every loop period while the device runs.  Nil for none.
 func (d *Device) SetLoop(handler func(d *Device)) {
+	d.mutex.Lock()
 	d.loop = handler
+	d.mutex.Unlock()
+
+	d.wake()
 }
 
+// Have the run loop look at the nodes, properties, and loop again
+func (d *Device) wake() {
+	select {
+	case d.wakeChannel <- struct{}{}:
+	default:
+	}
+}
+
+// True once the device is connected and has published itself, until the connection is lost
 func (d *Device) IsConnected() bool {
-	return d.connected
+	return d.connected.Load()
 }
 
 func (d *Device) SetTopicBase(b string) {
+	if d.configDone.Load() {
+		panic("Cannot set topic base on running device " + d.id)
+	}
 	d.topicBase = validate(b, false)
 }
 
@@ -94,13 +180,25 @@ func (d *Device) GetName() string {
 	return d.name
 }
 
+func (d *Device) Id() string {
+	return d.id
+}
+
+func (d *Device) TopicBase() string {
+	return d.topicBase
+}
+
+// The conventions the device is published under.  See SetProtocols().
+func (d *Device) Protocols() int {
+	return d.protocols
+}
+
 func (d *Device) topic(t string) string {
 	return d.topicBase + "/" + d.id + "/" + t
 }
 
 func (d *Device) publish(t, p string) {
-	token := d.client.Publish(d.topic(t), 1, true, p)
-	d.tokenChannel <- &token
+	d.publishRetained(d.topic(t), 1, p)
 }
 
 func durationToSeconds(d time.Duration) string {
@@ -108,27 +206,125 @@ func durationToSeconds(d time.Duration) string {
 	return strconv.FormatInt(n, 10)
 }
 
-// wait for all publications
+// wait for all publications queued so far
 func (d *Device) waitAllPublications() {
-tokenLoop:
+	f := make(flushToken)
+	d.tokenChannel <- f
+	<-f
+}
+
+// Wait for each publish token in turn, and finalize it.
+// Runs alongside the run loop.  Once abandon is closed, tokens still
+// outstanding are not waited for.
+func (d *Device) completeTokens(stop, abandon chan struct{}) {
 	for {
 		select {
 		case t := <-d.tokenChannel:
-			(*t).Wait()
-			d.tokenFinalize(t)
-		default:
-			break tokenLoop
+			if f, ok := t.(flushToken); ok {
+				close(f)
+				continue
+			}
+			select {
+			case <-t.Done():
+				d.tokenFinalize(t)
+			case <-abandon:
+			}
+		case <-stop:
+			return
 		}
 	}
 }
 
+// Start a new generation: the device is not connected, or is about to be
+// published again.  Returns the new generation.
+func (d *Device) newGeneration() uint64 {
+	d.generationMutex.Lock()
+	defer d.generationMutex.Unlock()
+
+	d.generation++
+	d.connected.Store(false)
+	return d.generation
+}
+
+func (d *Device) isCurrent(generation uint64) bool {
+	d.generationMutex.Lock()
+	defer d.generationMutex.Unlock()
+
+	return d.generation == generation
+}
+
+// Mark the device connected, unless a new generation has started.
+func (d *Device) setConnected(generation uint64) bool {
+	d.generationMutex.Lock()
+	defer d.generationMutex.Unlock()
+
+	if d.generation != generation {
+		return false
+	}
+	d.connected.Store(true)
+	return true
+}
+
 // Publish everything about this device.
 // This is done on connection to (and reconnection to) the mqtt broker
-// TODO: Don't let more than one of these routines run in parallel.
-func (d *Device) processConnect() {
-	// Emit the required properties.
-	d.publish("$state", "init")
+// It is done again whenever the nodes or properties change.
+// One runs at a time.  It gives up if the connection is lost, or if another
+// is started, before it is done.
+func (d *Device) processConnect(generation uint64) {
+	d.connectMutex.Lock()
+	defer d.connectMutex.Unlock()
+
+	if !d.isCurrent(generation) {
+		return
+	}
+	d.startRepublish()
+	d.publishState("init")
 	d.waitAllPublications() // force the "init" message out before any others.
+
+	// Stats providers and address lookups are not called with the mutex
+	// held.  They may block, or send values themselves.
+	if d.protocols&HomieV4 != 0 {
+		d.publishStats()
+		d.updateAddresses()
+	}
+
+	d.mutex.Lock()
+	if d.protocols&HomieV4 != 0 {
+		d.processConnectV4()
+	}
+	if d.protocols&HomieV5 != 0 {
+		d.processConnectV5()
+	}
+	d.mutex.Unlock()
+
+	if d.getBroadcastHandler() != nil {
+		d.subscribeToBroadcasts()
+	}
+
+	if !d.isCurrent(generation) {
+		d.waitAllPublications()
+		return
+	}
+	d.clearStale()
+	d.waitAllPublications()
+	if !d.setConnected(generation) {
+		return
+	}
+	d.publishState("ready")
+	if d.offline != nil {
+		d.offline.replay(d, generation)
+	}
+
+	// now, remove the temp subscriptions
+	for _, f := range d.unsubscribes {
+		f()
+	}
+	d.unsubscribes = make([]func(), 0, 10)
+}
+
+// Publish everything about this device under the v4 convention.
+func (d *Device) processConnectV4() {
+	// Emit the required properties.
 	d.publish("$homie", d.protocol)
 	d.publish("$name", d.name)
 	d.publish("$extensions", d.extensions)
@@ -136,20 +332,17 @@ func (d *Device) processConnect() {
 
 	// the extensions
 	d.publish("$stats/interval", durationToSeconds(d.statsInterval))
-	d.publish("$stats/uptime", durationToSeconds(time.Since(d.statsBootTime)))
 	d.publish("$localip", d.localIP)
 	d.publish("$mac", d.mac)
-	d.publish("$fw/name", d.fwName)
-	d.publish("$fw/version", d.fwVersion)
-
-	if d.broadcastHandler != nil {
-		d.subscribeToBroadcasts()
-	}
+	d.processConnectFirmware()
 
 	// Spit out the nodes
 	if len(d.nodes) > 0 {
 		s := ""
-		for n, _ := range d.nodes {
+		for n, node := range d.nodes {
+			if node.span {
+				n = n + "[]"
+			}
 			if len(s) > 0 {
 				s = s + "," + n
 			} else {
@@ -164,46 +357,65 @@ func (d *Device) processConnect() {
 	} else {
 		d.publish("$nodes", "")
 	}
-
-	d.waitAllPublications()
-	d.connected = true
-	d.publish("$state", "ready")
-
-	// now, remove the temp subscriptions
-	for _, f := range d.unsubscribes {
-		f()
-	}
-	d.unsubscribes = make([]func(), 0, 10)
 }
 
-func (d *Device) setLoopPeriod(period time.Duration) {
-	if d.configDone {
+// How often the loop runs.  The default is 250ms.
+// Zero runs it whenever the device has nothing else to do.
+func (d *Device) SetLoopPeriod(period time.Duration) {
+	if d.configDone.Load() {
 		panic("Cannot change loop period after calling Run() for device " + d.id)
 	}
+	if period < 0 {
+		panic("Negative loop period for device " + d.id)
+	}
 
 	d.period = period
 }
 
-// subscribe to the broadcast channel.
-// Blocks until broker acknowledges the subscription.
+// subscribe to the broadcast channel of each protocol the device speaks.
+// Blocks until broker acknowledges the subscriptions.
 func (d *Device) subscribeToBroadcasts() {
-	broadcastBase := d.topicBase + "/$broadcast/#"
-	token := d.client.Subscribe(broadcastBase, 0,
-		func(c mqtt.Client, m mqtt.Message) {
-			if d.broadcastHandler != nil {
-				topics := strings.SplitN(string(m.Topic()), "/", 3)
-				if len(topics) == 3 {
-					level := topics[2]
-					d.broadcastHandler(d, level, string(m.Payload()))
+	if d.protocols&HomieV4 != 0 {
+		d.subscribeToBroadcast(d.topicBase + "/$broadcast/")
+	}
+	if d.protocols&HomieV5 != 0 {
+		d.subscribeToBroadcast(d.topicBase + "/5/$broadcast/")
+	}
+}
+
+func (d *Device) subscribeToBroadcast(broadcastBase string) {
+	token := d.transport.Subscribe(broadcastBase+"#", 0,
+		func(topic string, payload []byte) {
+			if handler := d.getBroadcastHandler(); handler != nil {
+				level := strings.TrimPrefix(topic, broadcastBase)
+				if len(level) > 0 {
+					handler(d, level, string(payload))
 				}
 			}
 		})
 	token.Wait()
 	if token.Error() != nil {
-		panic(fmt.Sprintf("Error while subscribing to %s: %v", broadcastBase, token.Error()))
+		d.reportError(fmt.Errorf("Error while subscribing to %s: %w", broadcastBase+"#", token.Error()))
 	}
 }
 
+// How long a stopping device waits for its last publications, e.g. when
+// the broker is down and they will never complete
+const exitTimeout = time.Second
+
+// Is there anything but the loop callback for the run loop to do?
+func (d *Device) otherWorkPending(runContext context.Context, statsC <-chan time.Time) bool {
+	return len(d.publishQueue.ready) > 0 || len(d.connectChannel) > 0 ||
+		len(d.wakeChannel) > 0 || len(statsC) > 0 || runContext.Err() != nil
+}
+
+// A closed channel, for a loop that is always due
+var alwaysDue = func() chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
 // Run the control loop
 // All error conditions return by panic.
 // No normaal return
@@ -213,96 +425,108 @@ func (d *Device) Run() {
 
 func (d *Device) RunWithContext(runContext context.Context, waitChannel chan bool) {
 	var (
-		ticker *time.Ticker
+		loopTicker *time.Ticker
+		loopC      <-chan time.Time // fires when the loop is due
+		statsC     <-chan time.Time // fires when the stats are due
+		online     bool             // connected to the broker, if perhaps not yet configured
 	)
 
-	d.configDone = true
-	d.connected = false
+	d.configDone.Store(true)
+	d.connected.Store(false)
+	stopTokens, abandonTokens := make(chan struct{}), make(chan struct{})
+	go d.completeTokens(stopTokens, abandonTokens)
 	d.mqttSetup()
-	if d.period > 0 {
-		ticker = time.NewTicker(d.period)
+
+	// processConnect() publishes the stats on connection, after that it is up to us
+	if d.protocols&HomieV4 != 0 {
+		statsTicker := time.NewTicker(d.statsInterval)
+		defer statsTicker.Stop()
+		statsC = statsTicker.C
 	}
 
+	// Sleep until there is something to do
 runLoop:
 	for {
-		// Call the user's loop function
-		if d.loop != nil {
-			d.loop(d)
+		// Schedule the user's loop.  With a zero period it is always due.
+		d.mutex.Lock()
+		loop := d.loop
+		d.mutex.Unlock()
+		if loop == nil && loopC != nil {
+			if loopTicker != nil {
+				loopTicker.Stop()
+			}
+			loopTicker, loopC = nil, nil
+		} else if loop != nil && loopC == nil {
+			if d.period > 0 {
+				loopTicker = time.NewTicker(d.period)
+				loopC = loopTicker.C
+			} else {
+				loopC = alwaysDue
+			}
 		}
 
-		// Drain the channels
-	drain:
-		for {
-			// Process any accumulated publish tokens
-			// Do this without blocking.
-			// If we are not connected, let the connecting goroutine
-			// handle this.  Avoids simultaneous calls to d.tokenFinalize()
-			if d.connected {
-			tokenLoop:
-				for {
-					select {
-					case t := <-d.tokenChannel:
-						if (*t).WaitTimeout(time.Duration(0)) {
-							d.tokenFinalize(t)
-						} else {
-							d.tokenChannel <- t
-							break tokenLoop
-						}
-					default:
-						break tokenLoop
-					}
-				}
-			}
-			// non blocking
-			select {
-			case message := <-d.publishChannel:
-				// Message to publish?
+		// Have the nodes or properties changed?
+		if online && d.reconfigure.Swap(false) {
+			go d.processConnect(d.newGeneration())
+		}
+
+		select {
+		case <-d.publishQueue.ready:
+			// Messages to publish?
+			for message, ok := d.publishQueue.pop(); ok; message, ok = d.publishQueue.pop() {
 				message.publish()
+			}
 
-			case connected := <-d.connectChannel:
-				// Change in connection status?
-				if connected {
-					go d.processConnect()
-				}
+		case connected := <-d.connectChannel:
+			// Change in connection status?
+			online = connected
+			if connected {
+				d.reconfigure.Store(false)
+				d.otaSubscribed.Store(false)
+				go d.processConnect(d.newGeneration())
+			}
 
-			default:
-				// If nothing to do, don't block
-				break drain
+		case <-d.wakeChannel:
+
+		case <-loopC:
+			// With a zero period, the loop waits for everything else
+			if loopC == alwaysDue && d.otherWorkPending(runContext, statsC) {
+				continue
 			}
-		}
+			loop(d)
 
-		// now sleep for awhile if necessary
-		// Keep checking for work while sleeping.
-		// Note that there doesn't seem to be a good way of
-		// processing publish tokens here.
-		if d.period > 0 {
-		sleepLoop:
-			for {
-				select {
-				case message := <-d.publishChannel:
-					message.publish()
-				case connected := <-d.connectChannel:
-					if connected {
-						go d.processConnect()
-					}
-				case _ = <-ticker.C:
-					break sleepLoop
-				case <-runContext.Done():
-					break sleepLoop
-				}
+		case <-statsC:
+			if d.connected.Load() {
+				d.publishStats()
 			}
-		}
-		if runContext.Err() != nil {
+
+		case <-runContext.Done():
 			break runLoop
 		}
 	}
+	if loopTicker != nil {
+		loopTicker.Stop()
+	}
 
-	// Come here to disconnect and exit
-	d.publish("$state", "disconnected")
+	// Come here to disconnect and exit.  A processConnect() still running gives up,
+	// and is waited for.  Publications that do not complete within exitTimeout,
+	// its or ours, are abandoned.
+	d.newGeneration()
+	abandon := time.AfterFunc(exitTimeout, func() { close(abandonTokens) })
+	d.connectMutex.Lock()
+	if d.purgeOnExit.Load() {
+		d.purge()
+	} else {
+		d.publishState("disconnected")
+	}
 	d.waitAllPublications()
-	d.clientOptions.UnsetWill()
-	d.client.Disconnect(150) // disconnect in 0.15 seconds.
-	d.configDone = false
+	if !abandon.Stop() {
+		log.Printf("Device %s gave up on publications when stopping\n", d.id)
+	}
+	d.transport.Disconnect(150 * time.Millisecond)
+	close(stopTokens)
+	d.connectMutex.Unlock()
+	d.configDone.Store(false)
 	waitChannel <- true // signal we are done!
 	close(waitChannel)
 }
@@ -0,0 +1,29 @@
+package homie
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The CPU time used by the process
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatalf("getrusage: %v", err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// The CPU a connected device with nothing to do uses, per second it runs.
+// Each iteration is 10ms of idling, slept in one go so the benchmark itself
+// costs next to nothing.
+func BenchmarkDevice_IdleCPU(b *testing.B) {
+	runBenchmarkDevice(b, newFakeTransport())
+
+	b.ResetTimer()
+	start, startCPU := time.Now(), cpuTime(b)
+	time.Sleep(time.Duration(b.N) * 10 * time.Millisecond)
+	used, elapsed := cpuTime(b)-startCPU, time.Since(start)
+	b.ReportMetric(float64(used)/elapsed.Seconds(), "cpu-ns/s")
+}
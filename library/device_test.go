@@ -0,0 +1,174 @@
+package homie
+
+// test and benchmark the run loop
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDevice_Loop(t *testing.T) {
+	const period = 10 * time.Millisecond
+
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	p := d.NewNode("a-node", "Name a-node", "test", nil).Advertise("level", "Level", DtInteger)
+	d.SetLoopPeriod(period)
+	if err := try(func() { d.SetLoopPeriod(-time.Second) }); err == nil {
+		t.Errorf("negative loop period accepted")
+	}
+
+	var loops atomic.Int64
+	loop := func(d *Device) {
+		loops.Add(1)
+	}
+	d.SetLoop(loop)
+	runTestDevice(t, d, f)
+
+	waitFor(t, "the loop to run three times", func() bool {
+		return loops.Load() >= 3
+	})
+	if err := try(func() { d.SetLoopPeriod(time.Second) }); err == nil {
+		t.Errorf("loop period changed on running device")
+	}
+
+	// Each value is published by the run loop, so once it is out,
+	// the run loop has seen that the loop was removed
+	sendLevel := func(v int64) {
+		p.SetProperty().SendInt(v)
+		waitFor(t, "level "+strconv.FormatInt(v, 10), func() bool {
+			return f.retainedMessages()[d.topic("a-node/level")] == strconv.FormatInt(v, 10)
+		})
+	}
+
+	// Without a loop, the device sleeps until there is work
+	d.SetLoop(nil)
+	sendLevel(7)
+	n := loops.Load()
+	for v, start := int64(8), time.Now(); time.Since(start) < 3*period; v++ {
+		sendLevel(v)
+	}
+	if loops.Load() != n {
+		t.Errorf("loop ran %d times after it was removed", loops.Load()-n)
+	}
+
+	// A new loop is picked up at once
+	d.SetLoop(loop)
+	waitFor(t, "the loop to run again", func() bool {
+		return loops.Load() > n
+	})
+}
+
+// With a zero period the loop runs whenever there is nothing else to do
+func TestDevice_LoopPeriodZero(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	p := d.NewNode("a-node", "Name a-node", "test", nil).Advertise("level", "Level", DtInteger)
+	d.SetLoopPeriod(0)
+
+	// Each value sent is published before the loop runs again
+	var loops, late atomic.Int64
+	d.SetLoop(func(d *Device) {
+		n := loops.Add(1)
+		if n > 1 && n <= 1000 && f.retainedMessages()[d.topic("a-node/level")] != strconv.FormatInt(n-1, 10) {
+			late.Add(1)
+		}
+		if n < 1000 {
+			p.SetProperty().SendInt(n)
+		}
+	})
+
+	c, cfl := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cfl()
+	d.RunWithContext(c, make(chan bool, 1))
+	d.Destroy()
+
+	if loops.Load() < 1000 {
+		t.Errorf("loop ran only %d times", loops.Load())
+	}
+	if v := f.retainedMessages()[d.topic("a-node/level")]; v != "999" {
+		t.Errorf("level is \"%s\", expected 999", v)
+	}
+	if late.Load() > 0 {
+		t.Errorf("loop ran %d times with a value waiting to be published", late.Load())
+	}
+}
+
+// A token that never completes, as when the broker is down
+type pendingToken struct{}
+
+func (t pendingToken) Wait() bool                     { select {} }
+func (t pendingToken) WaitTimeout(time.Duration) bool { return false }
+func (t pendingToken) Error() error                   { return nil }
+func (t pendingToken) Done() <-chan struct{}          { return nil }
+
+// A fakeTransport whose publications stop completing
+type hungTransport struct {
+	*fakeTransport
+	hung atomic.Bool
+}
+
+func (h *hungTransport) Publish(topic string, qos byte, retained bool, payload string) Token {
+	if h.hung.Load() {
+		return pendingToken{}
+	}
+	return h.fakeTransport.Publish(topic, qos, retained, payload)
+}
+
+// A device stops even if its last publications never complete
+func TestDevice_StopWithBrokerDown(t *testing.T) {
+	h := &hungTransport{fakeTransport: newFakeTransport()}
+	d := createTestDevice()
+	d.SetTransport(h)
+	stop := runTestDevice(t, d, h.fakeTransport)
+
+	h.hung.Store(true)
+	stopped := make(chan bool)
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(exitTimeout + time.Second):
+		t.Fatalf("device did not stop")
+	}
+}
+
+// Run a device on a fake transport until the benchmark is done.
+// Returns once the device is ready.
+func runBenchmarkDevice(b *testing.B, f *fakeTransport) (*Device, *Property) {
+	d := createTestDevice()
+	d.SetTransport(f)
+	p := d.NewNode("a-node", "Name a-node", "test", nil).Advertise("level", "Level", DtInteger)
+	runTestDevice(b, d, f)
+	return d, p
+}
+
+// The time from Send() to the transport's Publish()
+func BenchmarkDevice_PublishLatency(b *testing.B) {
+	f := newFakeTransport()
+	published := make(chan bool, 1)
+	f.publishHook = func(topic, payload string) {
+		if !strings.HasSuffix(topic, "/a-node/level") {
+			return
+		}
+		select {
+		case published <- true:
+		default:
+		}
+	}
+	_, p := runBenchmarkDevice(b, f)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.SetProperty().SendInt(int64(i))
+		<-published
+	}
+}
@@ -0,0 +1,161 @@
+package homie
+
+//
+// This file contains the code for the legacy-firmware extension, and for
+// over the air updates in the style of homie-esp8266:
+//
+// A controller publishes the new firmware, raw or base64 encoded, to
+// $implementation/ota/firmware/<md5 of the firmware>.  The device checks it
+// and hands it to the OTA handler, reporting progress on $implementation/ota/status:
+//
+//	202              accepted, checking
+//	200              the handler installed it
+//	304              it is the firmware already running, or already installed
+//	409 IN_PROGRESS  another update is being installed
+//	400 BAD_CHECKSUM the checksum is malformed, or does not match
+//	400 BAD_FIRMWARE the firmware is empty
+//	500 FLASH_ERROR  the handler failed
+//
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+func (d *Device) SetFirmware(name, version string) {
+	if d.configDone.Load() {
+		panic("Cannot set firmware on running device " + d.id)
+	}
+	d.fwName = name
+	d.fwVersion = version
+}
+
+// The md5 of the running firmware, published as $fw/checksum.
+// Updates to the same firmware are refused with status 304.
+func (d *Device) SetFirmwareChecksum(checksum string) {
+	if d.configDone.Load() {
+		panic("Cannot set firmware checksum on running device " + d.id)
+	}
+	if !validChecksum(checksum) {
+		panic("Invalid firmware checksum " + checksum + " for device " + d.id)
+	}
+	d.fwChecksum = strings.ToLower(checksum)
+}
+
+// Enable over the air updates.  The handler is given each new firmware
+// once its checksum is verified, out of its own go routine, one at a time.
+// It may take its time, and should install the firmware and arrange a restart.
+// If it returns an error, the update is reported as failed.
+func (d *Device) SetOTAHandler(handler func(d *Device, firmware []byte) error) {
+	if d.configDone.Load() {
+		panic("Cannot set OTA handler on running device " + d.id)
+	}
+	d.otaHandler = handler
+}
+
+func validChecksum(checksum string) bool {
+	b, err := hex.DecodeString(checksum)
+	return err == nil && len(b) == md5.Size
+}
+
+// Publish the firmware attributes, and listen for updates
+func (d *Device) processConnectFirmware() {
+	d.publish("$fw/name", d.fwName)
+	d.publish("$fw/version", d.fwVersion)
+	if checksum := d.firmwareChecksum(); len(checksum) > 0 {
+		d.publish("$fw/checksum", checksum)
+	}
+
+	if d.otaHandler == nil {
+		d.publish("$implementation/ota/enabled", "false")
+		return
+	}
+	d.publish("$implementation/ota/enabled", "true")
+
+	// The subscription lasts as long as the connection.  Subscribing again
+	// would have the broker send any retained firmware again.
+	if d.otaSubscribed.Swap(true) {
+		return
+	}
+	prefix := d.topic("$implementation/ota/firmware/")
+	d.transport.Subscribe(prefix+"+", 1, func(topic string, payload []byte) {
+		go d.otaEvent(strings.TrimPrefix(topic, prefix), payload)
+	})
+}
+
+func (d *Device) firmwareChecksum() string {
+	d.otaMutex.Lock()
+	defer d.otaMutex.Unlock()
+
+	return d.fwChecksum
+}
+
+// Status messages are not retained
+func (d *Device) otaStatus(status string) {
+	d.tokenChannel <- d.transport.Publish(d.topic("$implementation/ota/status"), 1, false, status)
+}
+
+func (d *Device) otaEvent(checksum string, payload []byte) {
+	checksum = strings.ToLower(checksum)
+	if !validChecksum(checksum) {
+		d.otaStatus("400 BAD_CHECKSUM")
+		return
+	}
+
+	d.otaMutex.Lock()
+	if checksum == d.fwChecksum {
+		d.otaMutex.Unlock()
+		d.otaStatus("304")
+		return
+	}
+	if d.otaBusy {
+		d.otaMutex.Unlock()
+		d.otaStatus("409 IN_PROGRESS")
+		return
+	}
+	d.otaBusy = true
+	d.otaMutex.Unlock()
+
+	d.otaStatus("202")
+	status := d.otaInstall(checksum, payload)
+
+	// Done before the status goes out, so the next update sees it
+	d.otaMutex.Lock()
+	d.otaBusy = false
+	if status == "200" {
+		d.fwChecksum = checksum
+	}
+	d.otaMutex.Unlock()
+	d.otaStatus(status)
+}
+
+// Check the firmware and hand it to the handler.  Returns the final status.
+func (d *Device) otaInstall(checksum string, payload []byte) string {
+	if len(payload) == 0 {
+		return "400 BAD_FIRMWARE"
+	}
+
+	// The firmware may have been base64 encoded on the way
+	firmware := payload
+	if !matchesChecksum(firmware, checksum) {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(payload)))
+		if err != nil || !matchesChecksum(decoded, checksum) {
+			return "400 BAD_CHECKSUM"
+		}
+		firmware = decoded
+	}
+
+	if err := d.otaHandler(d, firmware); err != nil {
+		log.Printf("OTA update of device %s fails with error %v\n", d.id, err)
+		return "500 FLASH_ERROR"
+	}
+	return "200"
+}
+
+func matchesChecksum(firmware []byte, checksum string) bool {
+	return fmt.Sprintf("%x", md5.Sum(firmware)) == checksum
+}
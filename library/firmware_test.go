@@ -0,0 +1,192 @@
+package homie
+
+// test the firmware extension and OTA updates
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFirmware_Attributes(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	d.SetFirmware("thermostat", "1.2.3")
+	d.SetFirmwareChecksum("D41D8CD98F00B204E9800998ECF8427E")
+
+	c, cfl := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	d.RunWithContext(c, make(chan bool, 1))
+	cfl()
+
+	retained := f.retainedMessages()
+	expected := map[string]string{
+		"$fw/name":                    "thermostat",
+		"$fw/version":                 "1.2.3",
+		"$fw/checksum":                "d41d8cd98f00b204e9800998ecf8427e",
+		"$implementation/ota/enabled": "false",
+	}
+	for k, v := range expected {
+		if v2 := retained[d.topic(k)]; v2 != v {
+			t.Errorf("%s is \"%s\", expected \"%s\"", k, v2, v)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("bad checksum did not panic")
+		}
+	}()
+	d.SetFirmwareChecksum("1234")
+}
+
+func TestFirmware_OTA(t *testing.T) {
+	current := []byte("firmware 1")
+	update := []byte("firmware 2")
+	update2 := []byte("firmware 3")
+	update3 := []byte("firmware 4")
+	checksum := func(b []byte) string { return fmt.Sprintf("%x", md5.Sum(b)) }
+
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	d.SetFirmwareChecksum(checksum(current))
+
+	installed := make(chan []byte, 1)
+	fail := false
+	d.SetOTAHandler(func(d *Device, firmware []byte) error {
+		if fail {
+			return errors.New("disk full")
+		}
+		installed <- firmware
+		return nil
+	})
+
+	statuses := make(chan string, 10)
+	f.publishHook = func(topic, payload string) {
+		if topic == d.topic("$implementation/ota/status") {
+			statuses <- payload
+		}
+	}
+
+	runTestDevice(t, d, f)
+
+	expectStatuses := func(what string, expected ...string) {
+		for _, e := range expected {
+			select {
+			case s := <-statuses:
+				if s != e {
+					t.Errorf("%s: status \"%s\", expected \"%s\"", what, s, e)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: no status, expected \"%s\"", what, e)
+			}
+		}
+	}
+	send := func(checksum string, payload []byte) {
+		f.Publish(d.topic("$implementation/ota/firmware/"+checksum), 1, false, string(payload))
+	}
+
+	if v := f.retainedMessages()[d.topic("$implementation/ota/enabled")]; v != "true" {
+		t.Errorf("ota enabled is \"%s\"", v)
+	}
+
+	send(checksum(current), current)
+	expectStatuses("current", "304")
+
+	send(checksum(update), update)
+	expectStatuses("raw", "202", "200")
+	if b := <-installed; string(b) != string(update) {
+		t.Errorf("installed \"%s\"", b)
+	}
+
+	send(checksum(update2), []byte(base64.StdEncoding.EncodeToString(update2)))
+	expectStatuses("base64", "202", "200")
+	if b := <-installed; string(b) != string(update2) {
+		t.Errorf("installed \"%s\" from base64", b)
+	}
+
+	send(checksum(update2), update2)
+	expectStatuses("installed", "304")
+
+	send(checksum([]byte("something else")), update)
+	expectStatuses("mismatch", "202", "400 BAD_CHECKSUM")
+
+	send("banana", update)
+	expectStatuses("malformed", "400 BAD_CHECKSUM")
+
+	send(checksum(update3), nil)
+	expectStatuses("empty", "202", "400 BAD_FIRMWARE")
+
+	fail = true
+	send(checksum(update3), update3)
+	expectStatuses("failure", "202", "500 FLASH_ERROR")
+
+}
+
+func TestFirmware_OTAOneAtATime(t *testing.T) {
+	update := []byte("firmware 2")
+	other := []byte("firmware 3")
+	checksum := func(b []byte) string { return fmt.Sprintf("%x", md5.Sum(b)) }
+
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	d.SetOTAHandler(func(d *Device, firmware []byte) error {
+		started <- true
+		<-release
+		return nil
+	})
+
+	statuses := make(chan string, 10)
+	f.publishHook = func(topic, payload string) {
+		if topic == d.topic("$implementation/ota/status") {
+			statuses <- payload
+		}
+	}
+
+	runTestDevice(t, d, f)
+
+	expectStatus := func(what, expected string) {
+		select {
+		case s := <-statuses:
+			if s != expected {
+				t.Errorf("%s: status \"%s\", expected \"%s\"", what, s, expected)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no status, expected \"%s\"", what, expected)
+		}
+	}
+
+	// Retained, as a controller might leave it
+	f.Publish(d.topic("$implementation/ota/firmware/"+checksum(update)), 1, true, string(update))
+	expectStatus("update", "202")
+	<-started
+
+	f.Publish(d.topic("$implementation/ota/firmware/"+checksum(other)), 1, false, string(other))
+	expectStatus("second update", "409 IN_PROGRESS")
+
+	release <- true
+	expectStatus("update", "200")
+
+	// Republishing the device does not subscribe again, so the retained
+	// firmware is not delivered again.
+	createTestNode(d, "added")
+	waitFor(t, "the device to be republished", func() bool {
+		return f.publications(d.topic("$state"), "ready") > 1
+	})
+	time.Sleep(20 * time.Millisecond) // for firmware delivered again
+	select {
+	case s := <-statuses:
+		t.Errorf("status \"%s\" after republishing", s)
+	default:
+	}
+
+}
@@ -0,0 +1,129 @@
+package homie
+
+//
+// This file contains code to parse a property's $format attribute.
+//
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The parsed form of a property's $format attribute.
+// Only the fields that apply to the property's data type are filled in.
+type PropertyFormat struct {
+	HasMin bool     // numeric types: true if a lower limit was given
+	HasMax bool     // numeric types: true if an upper limit was given
+	Min    float64  // numeric types: lower limit
+	Max    float64  // numeric types: upper limit
+	Step   float64  // numeric types: step size, zero if none given
+	Values []string // enums: the allowed values, in order.  booleans: the false and true labels
+	Color  string   // colors: "rgb", "hsv", or "xyz"
+}
+
+// Parse a format string according to the data type.
+// Panics if the format is not legal for the data type.
+func (p *Property) parseFormat(format string) PropertyFormat {
+	var f PropertyFormat
+
+	switch p.dataType {
+	case DtInteger, DtFloat:
+		limits := strings.Split(format, ":")
+		if len(limits) < 2 || len(limits) > 3 {
+			p.formatPanic(format, "must be min:max or min:max:step")
+		}
+		f.Min, f.HasMin = p.parseLimit(format, limits[0])
+		f.Max, f.HasMax = p.parseLimit(format, limits[1])
+		if f.HasMin && f.HasMax && f.Min > f.Max {
+			p.formatPanic(format, "has min greater than max")
+		}
+		if len(limits) == 3 {
+			var ok bool
+			f.Step, ok = p.parseLimit(format, limits[2])
+			if !ok || f.Step <= 0 {
+				p.formatPanic(format, "has a step that is not positive")
+			}
+		}
+	case DtEnum:
+		f.Values = strings.Split(format, ",")
+		seen := make(map[string]bool)
+		for _, v := range f.Values {
+			if len(v) == 0 {
+				p.formatPanic(format, "has an empty enum value")
+			}
+			if seen[v] {
+				p.formatPanic(format, "has duplicate enum value "+v)
+			}
+			seen[v] = true
+		}
+	case DtColor:
+		if _, ok := colorLimits[format]; !ok {
+			p.formatPanic(format, "must be rgb, hsv, or xyz")
+		}
+		f.Color = format
+	case DtBoolean:
+		// v5 allows labels for false and true
+		f.Values = strings.Split(format, ",")
+		if len(f.Values) != 2 || len(f.Values[0]) == 0 || len(f.Values[1]) == 0 {
+			p.formatPanic(format, "must be false-label,true-label")
+		}
+	case DtJSON:
+		// v5 allows a JSON schema
+		if !json.Valid([]byte(format)) {
+			p.formatPanic(format, "is not a valid JSON schema")
+		}
+	default:
+		p.formatPanic(format, "is not allowed for this data type")
+	}
+
+	return f
+}
+
+// Parse one end of a numeric range.  Empty means no limit.
+func (p *Property) parseLimit(format, limit string) (float64, bool) {
+	if len(limit) == 0 {
+		return 0, false
+	}
+
+	var (
+		v   float64
+		err error
+	)
+	if p.dataType == DtInteger {
+		var n int64
+		n, err = strconv.ParseInt(limit, 10, 64)
+		v = float64(n)
+	} else {
+		v, err = strconv.ParseFloat(limit, 64)
+		if err == nil && (math.IsInf(v, 0) || math.IsNaN(v)) {
+			err = strconv.ErrSyntax
+		}
+	}
+	if err != nil {
+		p.formatPanic(format, "has an invalid limit \""+limit+"\"")
+	}
+	return v, true
+}
+
+func (p *Property) formatPanic(format, problem string) {
+	panic("format \"" + format + "\" for property " + p.id + " in node " + p.node.id + " " + problem)
+}
+
+// Returns the parsed form of the property's format.
+func (p *Property) ParsedFormat() PropertyFormat {
+	_, f := p.formats()
+	return f
+}
+
+// The format and its parsed form.  The format of a running device may be
+// changed at any time, so they are read under the device's mutex.
+// A controller's properties have no device, and its own mutex guards them.
+func (p *Property) formats() (string, PropertyFormat) {
+	if d := p.node.device; d != nil {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+	}
+	return p.format, p.parsedFormat
+}
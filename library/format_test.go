@@ -0,0 +1,85 @@
+package homie
+
+// test the parsing of property formats
+
+import (
+	"testing"
+)
+
+func expectFormatPanic(t *testing.T, dataType int, format string) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("format \"%s\" did not panic", format)
+		}
+	}()
+
+	p := createValueTestProperty(dataType, "")
+	p.SetFormat(format)
+}
+
+func TestFormat_Numeric(t *testing.T) {
+	p := createValueTestProperty(DtInteger, "0:100:5")
+	f := p.ParsedFormat()
+	if !f.HasMin || !f.HasMax || f.Min != 0 || f.Max != 100 || f.Step != 5 {
+		t.Errorf("format 0:100:5 parsed as %+v", f)
+	}
+	checkValues(t, p, []string{"0", "5", "100"}, []string{"3", "101"})
+
+	p = createValueTestProperty(DtFloat, ":1.5")
+	f = p.ParsedFormat()
+	if f.HasMin || !f.HasMax || f.Max != 1.5 || f.Step != 0 {
+		t.Errorf("format :1.5 parsed as %+v", f)
+	}
+
+	p = createValueTestProperty(DtFloat, "::0.25")
+	checkValues(t, p, []string{"0", "-0.5", "1.75"}, []string{"0.1"})
+
+	// An empty format takes the limits away
+	p.SetFormat("")
+	if f := p.ParsedFormat(); f.HasMin || f.HasMax || f.Step != 0 {
+		t.Errorf("empty format parsed as %+v", f)
+	}
+	checkValues(t, p, []string{"0.1"}, nil)
+
+	expectFormatPanic(t, DtInteger, "0-100")
+	expectFormatPanic(t, DtInteger, "0:1.5")
+	expectFormatPanic(t, DtInteger, "100:0")
+	expectFormatPanic(t, DtInteger, "0:100:0")
+	expectFormatPanic(t, DtFloat, "0:100:1:2")
+	expectFormatPanic(t, DtFloat, "a:b")
+}
+
+func TestFormat_Enum(t *testing.T) {
+	p := createValueTestProperty(DtEnum, "low,medium,high")
+	f := p.ParsedFormat()
+	if len(f.Values) != 3 || f.Values[0] != "low" || f.Values[2] != "high" {
+		t.Errorf("format low,medium,high parsed as %+v", f)
+	}
+
+	expectFormatPanic(t, DtEnum, "")
+	expectFormatPanic(t, DtEnum, "low,,high")
+	expectFormatPanic(t, DtEnum, "low,low")
+}
+
+func TestFormat_Color(t *testing.T) {
+	p := createValueTestProperty(DtColor, "hsv")
+	if f := p.ParsedFormat(); f.Color != "hsv" {
+		t.Errorf("format hsv parsed as %+v", f)
+	}
+
+	expectFormatPanic(t, DtColor, "RGB")
+	expectFormatPanic(t, DtColor, "")
+}
+
+func TestFormat_Other(t *testing.T) {
+	p := createValueTestProperty(DtBoolean, "off,on")
+	if f := p.ParsedFormat(); len(f.Values) != 2 || f.Values[1] != "on" {
+		t.Errorf("format off,on parsed as %+v", f)
+	}
+
+	expectFormatPanic(t, DtString, "anything")
+	expectFormatPanic(t, DtBoolean, "on")
+	expectFormatPanic(t, DtBoolean, "off,on,maybe")
+	expectFormatPanic(t, DtDatetime, "anything")
+	expectFormatPanic(t, DtJSON, "{not json")
+}
@@ -1,7 +1,8 @@
 package homie
 
 import (
-	"github.com/eclipse/paho.mqtt.golang"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,8 +20,24 @@ const (
 	DtBoolean
 	DtEnum
 	DtColor
+
+	// These were added by the v5 convention.  v4 publishes them as strings.
+	DtDatetime
+	DtDuration
+	DtJSON
 )
 
+// These are the conventions a device can be published under.
+// A device may be published under both at once.
+const (
+	HomieV4 = 1 << iota
+	HomieV5
+)
+
+// A color value.  The components are r,g,b or h,s,v or x,y,z
+// depending on the property's color format.
+type Color [3]float64
+
 // These are the allowed Property units.  Units however, are optional.
 var propertyUnits map[string]bool = map[string]bool{
 	"°C":     true, // degrees C
@@ -40,21 +57,29 @@ var propertyUnits map[string]bool = map[string]bool{
 }
 
 type Property struct {
-	id       string
-	name     string
-	node     *Node
-	settable bool // hardwired attribute
-	dataType int  // must be one of the defined data types
-	handler  func(d *Device, n *Node, p *Property, value string) bool
-	format   string
-	unit     string
-	value    string
+	id           string
+	name         string
+	node         *Node
+	settable     bool // hardwired attribute
+	retained     bool // false for events, whose values are neither kept nor republished
+	qos          byte // for the messages sent by SetProperty()
+	dataType     int  // must be one of the defined data types
+	handler      func(d *Device, n *Node, p *Property, value string) bool
+	format       string
+	parsedFormat PropertyFormat
+	unit         string
+	value        string   // guarded by the device's valueMutex
+	spanValues   []string // one value per index, for properties of spans.  Guarded likewise
+	setTopics    []string // the set topics subscribed to, dropped if the property is removed
+	removed      bool
 }
 
 type PropertyMessage struct {
 	property *Property
-	Qos      byte // default value is 1
-	Retained bool // default value is true
+	Qos      byte   // default value is 1
+	Retained bool   // default value is true
+	index    int    // index into the span, for properties of spans
+	value    string // the value sent.  Retained messages publish the latest value instead.
 }
 
 type Node struct {
@@ -64,51 +89,94 @@ type Node struct {
 	nType      string
 	handler    func(d *Device, n *Node, p *Property, value string) bool
 	properties map[string]*Property
+
+	// Stuff for spans
+	span        bool
+	lo          int
+	hi          int
+	spanNames   []string // friendly name of each index
+	spanHandler func(d *Device, n *Node, index int, p *Property, value string) bool
 }
 
 type Device struct {
 	id               string
-	protocol         string           // Homie level.  Always 4.0.1
-	name             string           // Friendly name
-	state            string           // Fixed set of states possible
-	nodes            map[string]*Node // indexed by node ID
-	extensions       string           // We currently support two, legacy-stats and legacy-firmware
-	implementation   string           // always "homieGo"
-	configDone       bool             // 2 states, configuring and configured
-	connected        bool
-	topicBase        string // default is "homie"
-	period           time.Duration
-	globalHandler    func(d *Device, n *Node, p *Property, value string) bool
+	protocol         string                                                   // Homie v4 level.  Always 4.0.0
+	protocols        int                                                      // HomieV4, HomieV5, or both
+	name             string                                                   // Friendly name
+	state            string                                                   // Fixed set of states possible
+	nodes            map[string]*Node                                         // indexed by node ID
+	extensions       string                                                   // We currently support two, legacy-stats and legacy-firmware
+	implementation   string                                                   // always "homieGo"
+	configDone       atomic.Bool                                              // 2 states, configuring and configured
+	strictValues     atomic.Bool                                              // if true, invalid property values are not published
+	connected        atomic.Bool                                              // connected, and done publishing the device
+	topicBase        string                                                   // default is "homie"
+	period           time.Duration                                            // how often the loop runs
+	globalHandler    func(d *Device, n *Node, p *Property, value string) bool // the handlers are guarded by mutex
 	broadcastHandler func(d *Device, level, value string)
+	errorHandler     func(d *Device, err error)
 	loop             func(d *Device)
 	mqttBroker       string
-	clientOptions    *mqtt.ClientOptions
-	client           mqtt.Client
-
-	unsubscribes []func()
-
-	// Stuff for the stats extension.  At the moment all we do is publish uptime.
-	statsInterval time.Duration // how often to publish stats
-	statsBootTime time.Time     // used to compute uptime
+	mqttVersion      int            // MqttV311 or MqttV5
+	security         brokerSecurity // credentials and TLS for the default transport
+	transport        Transport      // default is a PahoTransport for mqttBroker
+
+	unsubscribes []func() // guarded by connectMutex
+
+	// Each connection to the broker, lost connection, and reconfiguration is a new
+	// generation.  A processConnect() for an old generation gives up.
+	generationMutex sync.Mutex // guards generation, and makes the writes to connected agree with it
+	generation      uint64
+
+	valueMutex sync.Mutex // guards the values of the properties
+
+	// Stuff for changes to a running device
+	mutex         sync.Mutex      // guards nodes and properties, which may change while running
+	connectMutex  sync.Mutex      // one processConnect() at a time
+	reconfigure   atomic.Bool     // nodes or properties have changed since the last processConnect()
+	retainedMutex sync.Mutex      // guards retained and republished
+	retained      map[string]bool // the retained topics the device has published
+	republished   map[string]bool // those published by the running processConnect(), nil if none is running
+	purgeOnExit   atomic.Bool     // clear the retained topics when the run loop exits
+	offline       *offlineBuffer  // holds non-retained messages while disconnected, nil if none
+
+	// Stuff for the stats extension.
+	statsMutex     sync.Mutex                        // one publishStats() at a time
+	statsInterval  time.Duration                     // how often to publish stats
+	statsBootTime  time.Time                         // used to compute uptime
+	statsProviders map[string]func() (float64, bool) // the optional stats, indexed by name
 
 	// Stuff for the firmware extension.
-	localIP   string // NYI
-	mac       string // NYI
-	fwName    string
-	fwVersion string
-
-	// This channel is used to ensure that messages are not sent from an event handler
-	publishChannel chan PropertyMessage
+	localIP      string // found on connection, unless set
+	mac          string
+	localIPFixed bool // set with SetLocalIP()
+	macFixed     bool // set with SetMac()
+	fwName       string
+	fwVersion    string
+	fwChecksum   string // md5 of the running or installed firmware, "" if not known
+	otaHandler   func(d *Device, firmware []byte) error
+
+	// OTA updates run one at a time.  otaMutex guards fwChecksum once the device runs.
+	otaMutex      sync.Mutex
+	otaBusy       bool        // an update is being installed
+	otaSubscribed atomic.Bool // the firmware topic is subscribed on this connection
+
+	// The values to publish, so that messages are not sent from an event handler
+	publishQueue *publishQueue
 
 	// This channel reflects connection status changes back to the run() method from the event handler.
 	connectChannel chan bool
 
-	// This channel is used to process publish tokens at the right time and place, asynchronously
-	tokenChannel chan *mqtt.Token
+	// The publish tokens, completed in order by completeTokens()
+	tokenChannel chan Token
+
+	// Wakes the run loop to look again at the nodes, properties, and loop
+	wakeChannel chan struct{}
 }
 
 var (
-	devices map[string]*Device
+	devicesMutex sync.Mutex
+	devices      map[string]*Device
 )
 
 func init() {
@@ -0,0 +1,184 @@
+package homie
+
+//
+// This file contains the code to publish a device using the v5 convention.
+//
+// In v5 a device lives under <base>/5/<device>.  All of the device, node,
+// and property attributes are rolled up into one retained JSON document,
+// $description.  Property values and set messages use the same layout as v4.
+//
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const homieV5Version = "5.0"
+
+type descriptionV5 struct {
+	Homie   string                       `json:"homie"`
+	Version int64                        `json:"version"`
+	Name    string                       `json:"name,omitempty"`
+	Nodes   map[string]nodeDescriptionV5 `json:"nodes,omitempty"`
+}
+
+type nodeDescriptionV5 struct {
+	Name       string                           `json:"name,omitempty"`
+	Type       string                           `json:"type,omitempty"`
+	Properties map[string]propertyDescriptionV5 `json:"properties,omitempty"`
+}
+
+type propertyDescriptionV5 struct {
+	Name     string `json:"name,omitempty"`
+	Datatype string `json:"datatype"`
+	Format   string `json:"format,omitempty"`
+	Settable bool   `json:"settable,omitempty"`
+	Retained *bool  `json:"retained,omitempty"` // nil for the default, true
+	Unit     string `json:"unit,omitempty"`
+}
+
+func (d *Device) topicV5(t string) string {
+	return d.topicBase + "/5/" + d.id + "/" + t
+}
+
+func (d *Device) publishV5(t, p string) {
+	d.publishRetained(d.topicV5(t), 1, p)
+}
+
+// Publish the device state under every protocol the device speaks
+func (d *Device) publishState(state string) {
+	if d.protocols&HomieV4 != 0 {
+		d.publish("$state", state)
+	}
+	if d.protocols&HomieV5 != 0 {
+		d.publishV5("$state", state)
+	}
+}
+
+// The topic that carries the last will.  MQTT allows only one will,
+// so a device that speaks both protocols gets its will on the v4 $state.
+func (d *Device) willTopic() string {
+	if d.protocols&HomieV4 != 0 {
+		return d.topic("$state")
+	}
+	return d.topicV5("$state")
+}
+
+// The node ID used in v5 topics for one index of a span.
+// v5 has no node arrays, so each index is published as its own node.
+func (n *Node) indexIdV5(index int) string {
+	return n.id + "-" + strconv.Itoa(index)
+}
+
+// Build the $description document
+func (d *Device) descriptionV5() []byte {
+	desc := descriptionV5{
+		Homie: homieV5Version,
+		Name:  d.name,
+		Nodes: make(map[string]nodeDescriptionV5),
+	}
+
+	for _, n := range d.nodes {
+		properties := make(map[string]propertyDescriptionV5)
+		for _, p := range n.properties {
+			pd := propertyDescriptionV5{
+				Name:     p.name,
+				Datatype: dataTypeName(p.dataType),
+				Format:   p.format,
+				Settable: p.settable,
+				Unit:     p.unit,
+			}
+			if !p.retained {
+				pd.Retained = new(bool)
+			}
+			properties[p.id] = pd
+		}
+
+		if !n.span {
+			desc.Nodes[n.id] = nodeDescriptionV5{Name: n.name, Type: n.nType, Properties: properties}
+			continue
+		}
+		for i := n.lo; i <= n.hi; i++ {
+			desc.Nodes[n.indexIdV5(i)] = nodeDescriptionV5{Name: n.spanNames[i-n.lo], Type: n.nType, Properties: properties}
+		}
+	}
+
+	// The version must change whenever the description does, so use a hash of it.
+	b, _ := json.Marshal(desc)
+	h := fnv.New32a()
+	h.Write(b)
+	desc.Version = int64(h.Sum32())
+
+	b, _ = json.Marshal(desc)
+	return b
+}
+
+// Publish everything about this device under the v5 convention.
+// Called from processConnect().
+func (d *Device) processConnectV5() {
+	d.publishV5("$description", string(d.descriptionV5()))
+
+	for _, n := range d.nodes {
+		for _, p := range n.properties {
+			if !n.span {
+				p.processConnectV5(n.id, p.getValue(0), p.setEvent)
+				continue
+			}
+			for i := n.lo; i <= n.hi; i++ {
+				index := i
+				p.processConnectV5(n.indexIdV5(index), p.getValue(index), func(value string) {
+					p.setSpanEvent(index, value)
+				})
+			}
+		}
+	}
+}
+
+// Publish one property value and subscribe to its set messages
+func (p *Property) processConnectV5(nodeId, value string, setEvent func(value string)) {
+	d := p.node.device
+
+	if p.retained {
+		d.publishV5(nodeId+"/"+p.id, p.colorValueV5(value, p.parsedFormat.Color))
+	}
+	p.subscribeSet(d.topicV5(nodeId+"/"+p.id+"/set"), func(topic string, payload []byte) {
+		value, ok := p.valueFromV5(string(payload))
+		if !ok {
+			_, f := p.formats()
+			log.Printf("Rejected set: color \"%s\" for property %s in node %s is not %s\n",
+				string(payload), p.id, nodeId, f.Color)
+			return
+		}
+		setEvent(value)
+	})
+}
+
+// v5 color values carry the color format as a prefix: "rgb,255,0,0"
+func (p *Property) valueV5(value string) string {
+	_, f := p.formats()
+	return p.colorValueV5(value, f.Color)
+}
+
+// valueV5() for callers that hold the device's mutex
+func (p *Property) colorValueV5(value, color string) string {
+	if p.dataType == DtColor && len(value) > 0 {
+		return color + "," + value
+	}
+	return value
+}
+
+// Convert a v5 set value to the form used internally.  Returns false if it cannot be converted.
+func (p *Property) valueFromV5(value string) (string, bool) {
+	if p.dataType != DtColor {
+		return value, true
+	}
+	_, f := p.formats()
+	prefix := f.Color + ","
+	if !strings.HasPrefix(value, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(value, prefix), true
+}
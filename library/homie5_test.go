@@ -0,0 +1,117 @@
+package homie
+
+// test the v5 convention support
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHomie5_Description(t *testing.T) {
+	d := createTestDevice()
+	d.SetProtocols(HomieV5)
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+	p := n.Advertise("temperature", "Temperature", DtFloat)
+	p.SetUnit("°C")
+	p.SetFormat("-40:60")
+	n.Advertise("when", "When", DtDatetime).Settable(myTestHandler)
+	s := d.NewSpan("relay", "Relay", "test", 1, 2, nil)
+	s.Advertise("on", "On", DtBoolean)
+
+	var desc descriptionV5
+	b := d.descriptionV5()
+	if err := json.Unmarshal(b, &desc); err != nil {
+		t.Fatalf("description %s does not parse: %v", string(b), err)
+	}
+
+	if desc.Homie != "5.0" || desc.Name != "Test Device 0" || desc.Version == 0 {
+		t.Errorf("description header is wrong: %s", string(b))
+	}
+	temperature := desc.Nodes["a-node"].Properties["temperature"]
+	if temperature.Datatype != "float" || temperature.Unit != "°C" || temperature.Format != "-40:60" || temperature.Settable {
+		t.Errorf("temperature description is wrong: %+v", temperature)
+	}
+	if when := desc.Nodes["a-node"].Properties["when"]; when.Datatype != "datetime" || !when.Settable {
+		t.Errorf("when description is wrong: %+v", when)
+	}
+	if relay := desc.Nodes["relay-2"]; relay.Name != "Relay 2" || relay.Properties["on"].Datatype != "boolean" {
+		t.Errorf("span description is wrong: %+v", relay)
+	}
+
+	// A change to the description must change the version
+	n.Advertise("humidity", "Humidity", DtFloat)
+	var desc2 descriptionV5
+	json.Unmarshal(d.descriptionV5(), &desc2)
+	if desc2.Version == desc.Version {
+		t.Errorf("description version did not change")
+	}
+}
+
+func TestHomie5_Color(t *testing.T) {
+	p := createValueTestProperty(DtColor, "rgb")
+
+	if v := p.valueV5("1,2,3"); v != "rgb,1,2,3" {
+		t.Errorf("v5 color value is %s", v)
+	}
+	if v, ok := p.valueFromV5("rgb,1,2,3"); !ok || v != "1,2,3" {
+		t.Errorf("v5 color set value converts to %s, %v", v, ok)
+	}
+	if _, ok := p.valueFromV5("hsv,1,2,3"); ok {
+		t.Errorf("v5 hsv color set accepted for an rgb property")
+	}
+}
+
+func TestHomie5_DataTypes(t *testing.T) {
+	p := createValueTestProperty(DtDatetime, "")
+	checkValues(t, p, []string{"2024-01-31T12:00:00Z", "2024-01-31T12:00:00.5+01:00"}, []string{"yesterday", "2024-01-31"})
+
+	p = createValueTestProperty(DtDuration, "")
+	checkValues(t, p, []string{"PT12H5M46S", "PT1.5S", "PT3M"}, []string{"PT", "12:05:46", "P1D"})
+
+	p = createValueTestProperty(DtJSON, "")
+	checkValues(t, p, []string{`{"a":1}`, "[1,2]"}, []string{"{a:1}"})
+
+	if dataTypeNameV4(DtDuration) != "string" || dataTypeNameV4(DtColor) != "color" {
+		t.Errorf("v4 data type names are wrong")
+	}
+}
+
+// v4 controllers cannot parse the formats only v5 has
+func TestHomie5_FormatV4(t *testing.T) {
+	cases := []struct {
+		dataType int
+		format   string
+		v4       string
+	}{
+		{DtFloat, "0:10:0.5", "0:10"},
+		{DtInteger, ":100:5", ":100"},
+		{DtInteger, "0:100", "0:100"},
+		{DtEnum, "a,b", "a,b"},
+		{DtBoolean, "off,on", ""},
+		{DtJSON, `{"type":"object"}`, ""},
+	}
+	for _, c := range cases {
+		if v4 := createValueTestProperty(c.dataType, c.format).formatV4(); v4 != c.v4 {
+			t.Errorf("format %s is published under v4 as \"%s\", expected \"%s\"", c.format, v4, c.v4)
+		}
+	}
+}
+
+func TestHomie5_Protocols(t *testing.T) {
+	d := createTestDevice()
+	if d.willTopic() != "testing/"+d.id+"/$state" {
+		t.Errorf("v4 will topic is %s", d.willTopic())
+	}
+
+	d.SetProtocols(HomieV5)
+	if d.willTopic() != "testing/5/"+d.id+"/$state" {
+		t.Errorf("v5 will topic is %s", d.willTopic())
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("invalid protocols did not panic")
+		}
+	}()
+	d.SetProtocols(0)
+}
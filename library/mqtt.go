@@ -8,54 +8,161 @@ import (
 	"fmt"
 	"github.com/eclipse/paho.mqtt.golang"
 	"log"
+	"net"
+	"net/url"
+	"sync/atomic"
 	"time"
 )
 
-func (d *Device) mqttSetup() {
-	if d.connected {
-		panic("called setup on a connected device")
+// The default Transport, built on the paho mqtt client
+type PahoTransport struct {
+	clientOptions *mqtt.ClientOptions
+	client        mqtt.Client
+	broker        atomic.Pointer[url.URL] // the broker last connected to
+}
+
+func NewPahoTransport(broker, clientID string) *PahoTransport {
+	var t PahoTransport
+
+	t.clientOptions = mqtt.NewClientOptions()
+
+	// t.clientOptions.SetPingTimeout(1 * time.Second)	// default of 10 seconds is fine
+
+	t.clientOptions.SetKeepAlive(60 * time.Second)
+	t.clientOptions.SetCleanSession(true) // XXX	not sure which I want, but this way works, 'false' doesn't
+	t.clientOptions.AddBroker(broker)
+	t.clientOptions.SetClientID(clientID)
+	t.clientOptions.SetAutoReconnect(true)
+	t.clientOptions.SetConnectRetry(true)
+	t.clientOptions.SetConnectRetryInterval(time.Minute)
+
+	return &t
+}
+
+// The paho client options.  Changes take effect on the first call to Connect().
+func (t *PahoTransport) Options() *mqtt.ClientOptions {
+	return t.clientOptions
+}
+
+func (t *PahoTransport) Connect(will *Will, onConnect func(), onLost func(err error)) Token {
+	t.clientOptions.SetConnectionLostHandler(func(c mqtt.Client, e error) { onLost(e) })
+	t.clientOptions.SetOnConnectHandler(func(c mqtt.Client) { onConnect() })
+	t.clientOptions.SetConnectionNotificationHandler(func(c mqtt.Client, n mqtt.ConnectionNotification) {
+		if b, ok := n.(mqtt.ConnectionNotificationBroker); ok {
+			t.broker.Store(b.Broker)
+		}
+	})
+	if will != nil {
+		t.clientOptions.SetWill(will.Topic, will.Payload, will.Qos, will.Retained)
 	}
 
-	// re-use the existing clientOptions and client if we are reinitializing an existing device
-	if d.clientOptions == nil {
-		d.clientOptions = mqtt.NewClientOptions()
+	// re-use the existing client if we are reinitializing an existing device
+	if t.client == nil {
+		t.client = mqtt.NewClient(t.clientOptions)
 	}
 
-	// d.clientOptions.SetPingTimeout(1 * time.Second)	// default of 10 seconds is fine
+	return t.client.Connect()
+}
+
+func (t *PahoTransport) Publish(topic string, qos byte, retained bool, payload string) Token {
+	return t.client.Publish(topic, qos, retained, payload)
+}
 
-	d.clientOptions.SetKeepAlive(60 * time.Second)
-	d.clientOptions.SetCleanSession(true) // XXX	not sure which I want, but this way works, 'false' doesn't
-	d.clientOptions.AddBroker(d.mqttBroker)
-	d.clientOptions.SetClientID(mqttClientIDPrefix + "-" + d.id)
-	d.clientOptions.SetAutoReconnect(true)
-	d.clientOptions.SetConnectRetry(true)
-	d.clientOptions.SetConnectRetryInterval(time.Minute)
-	d.clientOptions.SetConnectionLostHandler(func(c mqtt.Client, e error) {
-		d.connected = false
-		d.connectChannel <- false
+func (t *PahoTransport) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) Token {
+	return t.client.Subscribe(topic, qos, func(c mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
 	})
-	d.clientOptions.SetOnConnectHandler(func(c mqtt.Client) { d.connectChannel <- true })
-	d.clientOptions.SetOrderMatters(false)
-	d.clientOptions.SetWill(d.topic("$state"), "lost", 1, true)
+}
 
-	if d.client == nil {
-		d.client = mqtt.NewClient(d.clientOptions)
+func (t *PahoTransport) Unsubscribe(topic string) Token {
+	return t.client.Unsubscribe(topic)
+}
+
+func (t *PahoTransport) Disconnect(quiesce time.Duration) {
+	t.client.Disconnect(uint(quiesce / time.Millisecond))
+}
+
+// The local address of the route to the broker.  paho does not expose its
+// connection, so ask the kernel by "connecting" a UDP socket, which sends nothing.
+func (t *PahoTransport) LocalAddr() net.IP {
+	return localAddrFor(t.broker.Load())
+}
+
+// The local address of the route to a broker, nil if not known
+func localAddrFor(broker *url.URL) net.IP {
+	if broker == nil {
+		return nil
+	}
+	port := broker.Port()
+	if len(port) == 0 {
+		port = "1883"
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(broker.Hostname(), port))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func (d *Device) mqttSetup() {
+	if d.connected.Load() {
+		panic("called setup on a connected device")
+	}
+
+	if d.transport == nil && d.mqttVersion == MqttV5 {
+		t := NewPahoV5Transport(d.mqttBroker, mqttClientIDPrefix+"-"+d.id)
+		t.SetOrderMatters(false)
+		d.security.applyV5(t)
+		d.transport = t
+	} else if d.transport == nil {
+		t := NewPahoTransport(d.mqttBroker, mqttClientIDPrefix+"-"+d.id)
+		t.Options().SetOrderMatters(false)
+		d.security.apply(t)
+		d.transport = t
 	}
 
-	token := d.client.Connect()
+	token := d.transport.Connect(&Will{Topic: d.willTopic(), Payload: "lost", Qos: 1, Retained: true},
+		func() { d.connectChannel <- true },
+		func(e error) {
+			d.newGeneration()
+			d.connectChannel <- false
+		})
 	// I don't know if token.Wait() will block, so ...
-	go func(t mqtt.Token) {
+	go func(t Token) {
 		t.Wait()
 		if t.Error() != nil {
-			panic(fmt.Sprintf("Mqtt connect fails with error %v", t.Error()))
+			d.reportError(fmt.Errorf("Mqtt connect fails with error %w", t.Error()))
 		}
 	}(token)
 }
 
+// Queued by waitAllPublications().  Closed by completeTokens() once the
+// tokens ahead of it are done.
+type flushToken chan struct{}
+
+func (f flushToken) Wait() bool {
+	<-f
+	return true
+}
+
+func (f flushToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-f:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (f flushToken) Done() <-chan struct{} { return f }
+func (f flushToken) Error() error          { return nil }
+
 // Check for publish errors. If found, log them.
 // Token t has already been waited for.
-func (d *Device) tokenFinalize(t *mqtt.Token) {
-	if e := (*t).Error(); e != nil {
+func (d *Device) tokenFinalize(t Token) {
+	if e := t.Error(); e != nil {
 		log.Printf("Publish error %v\n", e)
 	}
 }
@@ -0,0 +1,368 @@
+package homie
+
+//
+// This file contains the MQTT 5 transport, built on the paho v5 client.
+//
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/duke1swd/homieGo/broker"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// The MQTT protocol versions devices and controllers can speak
+const (
+	MqttV311 = 4 // the default, with the paho mqtt client
+	MqttV5   = 5 // with the paho v5 client
+)
+
+// Returned by the MQTT 5 transport when the broker refuses a publish,
+// subscribe, or unsubscribe.  Tells why, where MQTT 3.1.1 cannot.
+type ReasonCodeError struct {
+	Operation  string // "publish", "subscribe", or "unsubscribe"
+	Topic      string
+	ReasonCode byte   // 0x80 or above
+	Reason     string // the broker's explanation, if it gave one
+}
+
+func (e *ReasonCodeError) Error() string {
+	s := fmt.Sprintf("%s %s refused with reason code 0x%02x", e.Operation, e.Topic, e.ReasonCode)
+	if len(e.Reason) > 0 {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// A Transport built on the paho MQTT 5 client.
+// Publications to one topic are sent in order.  Publications to different
+// topics may pass one another, so wait for the tokens where order matters.
+type PahoV5Transport struct {
+	config         autopaho.ClientConfig
+	broker         *url.URL
+	brokerErr      error // why the broker URL would not parse
+	ordered        bool  // call the subscription handlers one at a time, in order
+	messageExpiry  *uint32
+	userProperties paho.UserProperties
+
+	mutex    sync.Mutex
+	manager  *autopaho.ConnectionManager
+	cancel   context.CancelFunc
+	ctx      context.Context                               // done when the transport disconnects
+	handlers map[string]func(topic string, payload []byte) // indexed by topic filter
+	pending  map[string]*pahoV5Token                       // the last publication to each topic, until it completes
+}
+
+func NewPahoV5Transport(broker, clientID string) *PahoV5Transport {
+	t := &PahoV5Transport{
+		ordered:  true,
+		handlers: make(map[string]func(topic string, payload []byte)),
+		pending:  make(map[string]*pahoV5Token),
+	}
+
+	t.broker, t.brokerErr = url.Parse(broker)
+	if t.brokerErr == nil {
+		t.config.ServerUrls = []*url.URL{t.broker}
+	}
+	t.config.ClientID = clientID
+	t.config.KeepAlive = 60
+	t.config.CleanStartOnInitialConnection = true
+
+	return t
+}
+
+// The paho v5 client configuration.  Changes take effect on the next call to Connect().
+// The will and the connection callbacks are set by Connect().
+func (t *PahoV5Transport) Config() *autopaho.ClientConfig {
+	return &t.config
+}
+
+// If false, subscription handlers are each called in their own go routine,
+// so a slow handler does not hold up the others.  The default is true.
+func (t *PahoV5Transport) SetOrderMatters(ordered bool) {
+	t.ordered = ordered
+}
+
+// Publications expire if the broker cannot deliver them within d.
+// This applies to every publication, retained ones included.  Zero for no expiry.
+func (t *PahoV5Transport) SetMessageExpiry(d time.Duration) {
+	if d <= 0 {
+		t.messageExpiry = nil
+		return
+	}
+	seconds := uint32((d + time.Second - 1) / time.Second)
+	t.messageExpiry = &seconds
+}
+
+// Send a user property with every publication
+func (t *PahoV5Transport) SetUserProperty(key, value string) {
+	t.userProperties.Add(key, value)
+}
+
+// Tracks an operation of the MQTT 5 transport
+type pahoV5Token struct {
+	done chan struct{}
+	err  error
+	once sync.Once
+}
+
+func newPahoV5Token() *pahoV5Token {
+	return &pahoV5Token{done: make(chan struct{})}
+}
+
+func (t *pahoV5Token) complete(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *pahoV5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *pahoV5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *pahoV5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *pahoV5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// The token completes when the first connection is made.  Until then the
+// transport keeps trying, as the 3.1.1 transport does.
+func (t *PahoV5Transport) Connect(will *Will, onConnect func(), onLost func(err error)) Token {
+	token := newPahoV5Token()
+	if t.brokerErr != nil {
+		token.complete(t.brokerErr)
+		return token
+	}
+
+	config := t.config
+	if will != nil {
+		config.WillMessage = &paho.WillMessage{
+			Topic:   will.Topic,
+			Payload: []byte(will.Payload),
+			QoS:     will.Qos,
+			Retain:  will.Retained,
+		}
+		config.WillProperties = &paho.WillProperties{}
+	}
+	config.OnConnectionUp = func(*autopaho.ConnectionManager, *paho.Connack) {
+		token.complete(nil)
+		onConnect()
+	}
+	config.OnConnectionDown = func() bool {
+		onLost(fmt.Errorf("connection to %s lost", t.broker))
+		return true
+	}
+	config.OnPublishReceived = append(config.OnPublishReceived, t.receive)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	manager, err := autopaho.NewConnection(ctx, config)
+	if err != nil {
+		cancel()
+		token.complete(err)
+		return token
+	}
+
+	t.mutex.Lock()
+	t.manager = manager
+	t.ctx = ctx
+	t.cancel = cancel
+	t.mutex.Unlock()
+	return token
+}
+
+// Deliver a message to the handlers of the subscriptions it matches
+func (t *PahoV5Transport) receive(r paho.PublishReceived) (bool, error) {
+	topic := r.Packet.Topic
+	payload := r.Packet.Payload
+
+	t.mutex.Lock()
+	handlers := make([]func(topic string, payload []byte), 0, 1)
+	for filter, handler := range t.handlers {
+		if broker.FilterMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, handler := range handlers {
+		if t.ordered {
+			handler(topic, payload)
+		} else {
+			go handler(topic, payload)
+		}
+	}
+	return true, nil
+}
+
+// Run an operation against the connection in its own go routine
+func (t *PahoV5Transport) run(token *pahoV5Token, previous *pahoV5Token,
+	operation func(ctx context.Context, m *autopaho.ConnectionManager) error) {
+	t.mutex.Lock()
+	manager := t.manager
+	ctx := t.ctx
+	t.mutex.Unlock()
+
+	if manager == nil {
+		token.complete(fmt.Errorf("not connected to %s", t.broker))
+		return
+	}
+
+	go func() {
+		if previous != nil {
+			<-previous.done
+		}
+		token.complete(operation(ctx, manager))
+	}()
+}
+
+func (t *PahoV5Transport) Publish(topic string, qos byte, retained bool, payload string) Token {
+	p := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: []byte(payload),
+	}
+	if t.messageExpiry != nil || len(t.userProperties) > 0 {
+		p.Properties = &paho.PublishProperties{MessageExpiry: t.messageExpiry, User: t.userProperties}
+	}
+
+	// Wait for the last publication to this topic
+	token := newPahoV5Token()
+	t.mutex.Lock()
+	previous := t.pending[topic]
+	t.pending[topic] = token
+	t.mutex.Unlock()
+
+	t.run(token, previous, func(ctx context.Context, m *autopaho.ConnectionManager) error {
+		response, err := m.Publish(ctx, p)
+
+		t.mutex.Lock()
+		if t.pending[topic] == token {
+			delete(t.pending, topic)
+		}
+		t.mutex.Unlock()
+
+		if response != nil && response.ReasonCode >= 0x80 {
+			e := &ReasonCodeError{Operation: "publish", Topic: topic, ReasonCode: response.ReasonCode}
+			if response.Properties != nil {
+				e.Reason = response.Properties.ReasonString
+			}
+			return e
+		}
+		return err
+	})
+	return token
+}
+
+func (t *PahoV5Transport) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) Token {
+	// The handler must be in place before the broker sends the retained messages
+	t.mutex.Lock()
+	t.handlers[topic] = handler
+	t.mutex.Unlock()
+
+	token := newPahoV5Token()
+	t.run(token, nil, func(ctx context.Context, m *autopaho.ConnectionManager) error {
+		suback, err := m.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+		})
+		if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+			e := &ReasonCodeError{Operation: "subscribe", Topic: topic, ReasonCode: suback.Reasons[0]}
+			if suback.Properties != nil {
+				e.Reason = suback.Properties.ReasonString
+			}
+			return e
+		}
+		return err
+	})
+	return token
+}
+
+func (t *PahoV5Transport) Unsubscribe(topic string) Token {
+	t.mutex.Lock()
+	delete(t.handlers, topic)
+	t.mutex.Unlock()
+
+	token := newPahoV5Token()
+	t.run(token, nil, func(ctx context.Context, m *autopaho.ConnectionManager) error {
+		_, err := m.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+		return err
+	})
+	return token
+}
+
+func (t *PahoV5Transport) Disconnect(quiesce time.Duration) {
+	t.mutex.Lock()
+	manager := t.manager
+	cancel := t.cancel
+	t.manager = nil
+	t.mutex.Unlock()
+
+	if manager == nil {
+		return
+	}
+	ctx, cancelWait := context.WithTimeout(context.Background(), quiesce)
+	defer cancelWait()
+	manager.Disconnect(ctx)
+	cancel()
+}
+
+func (t *PahoV5Transport) LocalAddr() net.IP {
+	t.mutex.Lock()
+	connected := t.manager != nil
+	t.mutex.Unlock()
+
+	if !connected {
+		return nil
+	}
+	return localAddrFor(t.broker)
+}
+
+// Speak MQTT 5 to the broker, or MqttV311, the default.
+// Not used with a transport set with SetTransport().
+func (d *Device) SetMqttVersion(version int) {
+	if d.configDone.Load() {
+		panic("Cannot set mqtt version on running device " + d.id)
+	}
+	if version != MqttV311 && version != MqttV5 {
+		panic("Invalid mqtt version for device " + d.id)
+	}
+	d.mqttVersion = version
+}
+
+func (c *Controller) SetMqttVersion(version int) {
+	if c.connected.Load() {
+		panic("Cannot set mqtt version on connected controller")
+	}
+	if version != MqttV311 && version != MqttV5 {
+		panic("Invalid mqtt version for controller")
+	}
+	c.mqttVersion = version
+}
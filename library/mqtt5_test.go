@@ -0,0 +1,198 @@
+package homie
+
+// test the MQTT 5 transport against the embedded broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duke1swd/homieGo/broker"
+)
+
+// Start a broker that refuses publications to topics that end in "locked/set"
+func startMqtt5Broker(t *testing.T) *broker.Broker {
+	b := broker.New()
+	b.SetAuthorizer(func(clientID, topic string) bool {
+		return !strings.HasSuffix(topic, "locked/set")
+	})
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Broker Listen failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func connectV5Transport(t *testing.T, b *broker.Broker, clientID string) *PahoV5Transport {
+	transport := NewPahoV5Transport(b.URL(), clientID)
+	token := transport.Connect(nil, func() {}, func(error) {})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Connect failed: %v", token.Error())
+	}
+	t.Cleanup(func() { transport.Disconnect(50 * time.Millisecond) })
+	return transport
+}
+
+func TestMqtt5_Transport(t *testing.T) {
+	b := startMqtt5Broker(t)
+
+	if token := NewPahoV5Transport(b.URL(), "unconnected").Publish("a/b", 1, false, "x"); token.Wait() && token.Error() == nil {
+		t.Errorf("publish without a connection succeeded")
+	}
+
+	pub := connectV5Transport(t, b, "pub")
+	pub.SetUserProperty("source", "test")
+	pub.SetMessageExpiry(time.Minute)
+
+	// Publications to one topic arrive in order
+	var last Token
+	for i := 1; i <= 50; i++ {
+		last = pub.Publish("testing/counter", 1, true, fmt.Sprint(i))
+	}
+	last.Wait()
+	if err := last.Error(); err != nil {
+		t.Errorf("Publish failed: %v", err)
+	}
+
+	sub := connectV5Transport(t, b, "sub")
+	received := make(chan string, 10)
+	sub.Subscribe("testing/#", 1, func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	}).Wait()
+	select {
+	case m := <-received:
+		if m != "testing/counter 50" {
+			t.Errorf("retained %s, expected testing/counter 50", m)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("retained counter was not delivered")
+	}
+
+	token := pub.Publish("testing/dev/node/locked/set", 1, false, "true")
+	token.Wait()
+	var reason *ReasonCodeError
+	if !errors.As(token.Error(), &reason) || reason.ReasonCode != 0x87 || reason.Operation != "publish" {
+		t.Errorf("refused publish returned %v", token.Error())
+	}
+
+	sub.Unsubscribe("testing/#").Wait()
+	pub.Publish("testing/other", 1, false, "x").Wait()
+	select {
+	case m := <-received:
+		t.Errorf("received %s after unsubscribing", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMqtt5_Device(t *testing.T) {
+	b := startMqtt5Broker(t)
+
+	d := createTestDevice()
+	d.SetMqttBroker(b.URL())
+	d.SetMqttVersion(MqttV5)
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+	sets := make(chan string, 10)
+	n.Advertise("level", "Level", DtInteger).Settable(func(d *Device, n *Node, p *Property, value string) bool {
+		sets <- value
+		p.SetProperty().Send(value)
+		return true
+	})
+	n.Advertise("locked", "Locked", DtBoolean).Settable(myTestHandler)
+
+	waitChannel := make(chan bool, 1)
+	ctx, cfl := context.WithCancel(context.Background())
+	go d.RunWithContext(ctx, waitChannel)
+	defer func() {
+		cfl()
+		for _ = range waitChannel {
+		}
+		d.Destroy()
+	}()
+
+	c := NewController(testTopicBase)
+	c.SetMqttBroker(b.URL())
+	c.SetMqttVersion(MqttV5)
+	if err := c.Connect(5 * time.Second); err != nil {
+		t.Fatalf("controller Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+
+	start := time.Now()
+	for cd := c.Device(d.id); cd == nil || cd.State() != "ready" || cd.Node("a-node") == nil; cd = c.Device(d.id) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("device did not reach ready over MQTT 5")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	setCtx, setCfl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer setCfl()
+	if err := c.Set(setCtx, d.id, "a-node", "level", "7"); err != nil {
+		t.Errorf("Set failed: %v", err)
+	}
+	select {
+	case v := <-sets:
+		if v != "7" {
+			t.Errorf("device was set to %s, expected 7", v)
+		}
+	default:
+		t.Errorf("device handler was not called")
+	}
+
+	// The broker says why it refused the set
+	err := c.Set(setCtx, d.id, "a-node", "locked", "true")
+	var reason *ReasonCodeError
+	if !errors.As(err, &reason) || reason.ReasonCode != 0x87 || len(reason.Reason) == 0 {
+		t.Errorf("refused set returned %v", err)
+	}
+}
+
+func TestMqtt5_BadVersion(t *testing.T) {
+	d := createTestDevice()
+	defer d.Destroy()
+	if err := try(func() { d.SetMqttVersion(3) }); err == nil {
+		t.Errorf("mqtt version 3 was accepted")
+	}
+}
+
+// With the broker down, the device and the controller keep trying rather than fail
+func TestMqtt5_BrokerDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	url := "tcp://" + l.Addr().String()
+	l.Close()
+
+	d := createTestDevice()
+	d.SetMqttBroker(url)
+	d.SetMqttVersion(MqttV5)
+	errorChannel := make(chan error, 1)
+	d.SetErrorHandler(func(d *Device, err error) {
+		errorChannel <- err
+	})
+
+	ctx, cfl := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	d.RunWithContext(ctx, make(chan bool, 1))
+	cfl()
+	d.Destroy()
+	select {
+	case err := <-errorChannel:
+		t.Errorf("device reported %v", err)
+	default:
+	}
+
+	c := NewController(testTopicBase)
+	c.SetMqttBroker(url)
+	c.SetMqttVersion(MqttV5)
+	if err := c.Connect(200 * time.Millisecond); err == nil {
+		t.Errorf("controller connected to nothing")
+	}
+	if transport := c.transport.(*PahoV5Transport); transport.manager != nil {
+		t.Errorf("controller transport is still trying")
+	}
+}
@@ -6,17 +6,22 @@ package homie
 //
 
 import (
+	"github.com/duke1swd/homieGo/broker"
 	"github.com/eclipse/paho.mqtt.golang"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 var (
-	allTopics         map[string]string
-	testClient        mqtt.Client
-	timeoutChannel    chan int = make(chan int)
-	clientInitialized bool     = false
+	allTopics      map[string]string
+	collecting     map[string]string // the topics seen so far by getMqttStuff, guarded by topicsMutex
+	topicsMutex    sync.Mutex
+	testClient     mqtt.Client
+	testBroker     *broker.Broker
+	timeoutChannel chan int = make(chan int, 1)
 )
 
 var f1 mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
@@ -28,21 +33,37 @@ var f1 mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
-	if strings.Contains(topic, "firmware") {
-		payload = "(suppressed)"
+	// Messages that arrive after getMqttStuff() is done are ignored
+	topicsMutex.Lock()
+	if collecting == nil {
+		topicsMutex.Unlock()
+		return
 	}
+	collecting[topic] = payload
+	topicsMutex.Unlock()
 
 	// tell the world we are still working
-	timeoutChannel <- 0
-
-	allTopics[topic] = payload
+	select {
+	case timeoutChannel <- 0:
+	default:
+	}
 }
 
+// Start a fresh broker for this test, and connect the test client to it.
+// Devices created by createTestDevice() after this use the same broker.
 func getTestClient(t *testing.T) {
-	if clientInitialized {
-		return
+	testBroker = broker.New()
+	if err := testBroker.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Broker Listen failed: %v", err)
 	}
-	opts := mqtt.NewClientOptions().AddBroker("tcp://127.0.0.1:1883").SetClientID("fw-test")
+	b := testBroker
+	t.Cleanup(func() {
+		testClient.Disconnect(0)
+		b.Close()
+		testBroker = nil
+	})
+
+	opts := mqtt.NewClientOptions().AddBroker(testBroker.URL()).SetClientID("fw-test")
 	opts.SetKeepAlive(60 * time.Second)
 	opts.SetDefaultPublishHandler(f1)
 	opts.SetPingTimeout(1 * time.Second)
@@ -52,13 +73,14 @@ func getTestClient(t *testing.T) {
 		t.Errorf("MQTT Connect`failed: %v", token.Error())
 	}
 	testClient = c
-	clientInitialized = true
 }
 
 // get all the persistent messages and build a map of everything we know about everybody
 func getMqttStuff(t *testing.T) {
 	c := testClient
-	allTopics = make(map[string]string)
+	topicsMutex.Lock()
+	collecting = make(map[string]string)
+	topicsMutex.Unlock()
 
 	subscription := testTopicBase + "/#"
 
@@ -84,6 +106,10 @@ waitLoop:
 	if token := c.Unsubscribe(subscription); token.Wait() && token.Error() != nil {
 		t.Errorf("MQTT Unsubscribe failed: %v", token.Error())
 	}
+
+	topicsMutex.Lock()
+	allTopics, collecting = collecting, nil
+	topicsMutex.Unlock()
 }
 
 func cleanMqtt(t *testing.T) {
@@ -102,6 +128,18 @@ func getAllMqtt(t *testing.T) map[string]string {
 	return allTopics
 }
 
+// $nodes and $properties are lists in no particular order
+func sameList(topic, v1, v2 string) bool {
+	if !strings.HasSuffix(topic, "/$nodes") && !strings.HasSuffix(topic, "/$properties") {
+		return false
+	}
+	l1 := strings.Split(v1, ",")
+	l2 := strings.Split(v2, ",")
+	sort.Strings(l1)
+	sort.Strings(l2)
+	return strings.Join(l1, ",") == strings.Join(l2, ",")
+}
+
 func verifyMqtt(t *testing.T, messageMaps ...map[string]string) map[string]string {
 	getMqttStuff(t)
 
@@ -109,7 +147,7 @@ func verifyMqtt(t *testing.T, messageMaps ...map[string]string) map[string]strin
 	for _, messages := range messageMaps {
 		for k, v := range messages {
 			if v2, ok := allTopics[k]; ok {
-				if v != "*" && v != v2 {
+				if v != "*" && v != v2 && !sameList(k, v, v2) {
 					t.Errorf("For topic %s expected value \"%s\" found value \"%s\"", k, v, v2)
 				}
 			} else {
@@ -2,50 +2,67 @@ package homie
 
 // Node methods
 
-// Create and return a node
+// Create and return a node.
+// Nodes may be added to a running device; it republishes itself to announce them.
 func (device *Device) NewNode(id, name, nType string, handler func(d *Device, n *Node, p *Property, a string) bool) *Node {
 	var node Node
 
-	id = validate(id, false)
-
-	if device.configDone {
-		panic("Cannot add node " + id + " to device " + device.name +
-			" after calling device.Run()")
-	}
-
-	if _, ok := device.nodes[id]; ok {
-		panic("Device " + device.name + " already has a node " + id)
-	}
-
-	node.id = id
+	node.id = validate(id, false)
 	node.name = name
 	node.nType = nType
 	node.properties = make(map[string]*Property)
 	node.handler = handler
 	node.device = device
 
-	device.nodes[id] = &node
+	device.addNode(&node)
 
 	return &node
 }
 
-func (n *Node) Advertise(id, name string, dataType int) *Property {
-	var property Property
+func (device *Device) addNode(node *Node) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
 
-	id = validate(id, false)
+	if _, ok := device.nodes[node.id]; ok {
+		panic("Device " + device.name + " already has a node " + node.id)
+	}
+	device.nodes[node.id] = node
+	device.changed()
+}
 
-	if n.device.configDone {
-		panic("Cannot add property " + id + " to node " + n.name +
-			" after calling device.Run()")
+// Remove a node.  A running device republishes itself without the node,
+// and clears the node's retained topics.
+func (device *Device) RemoveNode(id string) {
+	device.mutex.Lock()
+	n, ok := device.nodes[id]
+	if !ok {
+		device.mutex.Unlock()
+		panic("Device " + device.name + " has no node " + id)
 	}
+	delete(device.nodes, id)
+	device.changed()
+	properties := make([]*Property, 0, len(n.properties))
+	for _, p := range n.properties {
+		properties = append(properties, p)
+	}
+	device.mutex.Unlock()
 
-	if _, ok := n.properties[id]; ok {
-		panic("duplicate property id " + id + " in node " + n.name)
+	for _, p := range properties {
+		p.remove()
 	}
+}
+
+// Properties may be added to a running device; it republishes itself to announce them.
+func (n *Node) Advertise(id, name string, dataType int) *Property {
+	var property Property
+
+	id = validate(id, false)
 
 	property.id = id
 	property.name = name
 	property.settable = false
+	property.retained = true
+	property.qos = 1
 
 	switch dataType {
 	case DtString:
@@ -54,6 +71,9 @@ func (n *Node) Advertise(id, name string, dataType int) *Property {
 	case DtBoolean:
 	case DtEnum:
 	case DtColor:
+	case DtDatetime:
+	case DtDuration:
+	case DtJSON:
 	default:
 		panic("Invalid data type supplied for property " + id + " in node " + n.name)
 	}
@@ -63,12 +83,41 @@ func (n *Node) Advertise(id, name string, dataType int) *Property {
 	property.unit = ""
 
 	property.handler = nil
-	n.properties[id] = &property
+	if n.span {
+		property.spanValues = make([]string, n.hi-n.lo+1)
+	}
 	property.node = n
 
+	d := n.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := n.properties[id]; ok {
+		panic("duplicate property id " + id + " in node " + n.name)
+	}
+	n.properties[id] = &property
+	d.changed()
+
 	return &property
 }
 
+// Remove a property.  A running device republishes itself without the property,
+// and clears the property's retained topics.
+func (n *Node) RemoveProperty(id string) {
+	d := n.device
+	d.mutex.Lock()
+	p, ok := n.properties[id]
+	if !ok {
+		d.mutex.Unlock()
+		panic("Node " + n.id + " in device " + d.name + " has no property " + id)
+	}
+	delete(n.properties, id)
+	d.changed()
+	d.mutex.Unlock()
+
+	p.remove()
+}
+
 func (n Node) Id() string {
 	return n.id
 }
@@ -92,6 +141,9 @@ func (n *Node) publish(topic, payload string) {
 func (n *Node) processConnect() {
 	n.publish("$name", n.name)
 	n.publish("$type", n.nType)
+	if n.span {
+		n.processConnectSpan()
+	}
 
 	// Spit out the properties
 	if len(n.properties) > 0 {
@@ -0,0 +1,168 @@
+package homie
+
+//
+// This file contains the offline buffer, which holds non-retained messages
+// while the device is disconnected, and replays them once it is ready again.
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// A message held while the device was disconnected
+type offlineMessage struct {
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Payload string `json:"payload"`
+}
+
+type offlineBuffer struct {
+	mutex    sync.Mutex // guards messages, and keeps the publications in order
+	messages []offlineMessage
+	size     int    // the most messages held
+	path     string // the file the messages are kept in, "" for none
+
+	dropped atomic.Uint64
+}
+
+// Hold up to size non-retained messages while the device is not ready, and
+// publish them in order once it is.  When the buffer is full the oldest
+// message is dropped.  If path is not "", the messages are kept in that file
+// too, so they survive a restart.  Zero size for no buffer, the default.
+func (d *Device) SetOfflineBuffer(size int, path string) {
+	if d.configDone.Load() {
+		panic("Cannot set offline buffer on running device " + d.id)
+	}
+	if size < 0 {
+		panic("Negative offline buffer size for device " + d.id)
+	}
+	if size == 0 {
+		d.offline = nil
+		return
+	}
+
+	b := &offlineBuffer{size: size, path: path}
+	b.load()
+	d.offline = b
+}
+
+// Publish a non-retained message, or hold it if the device is not ready
+// or there are messages ahead of it still to replay.
+func (b *offlineBuffer) publish(d *Device, topic string, qos byte, payload string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if d.connected.Load() && len(b.messages) == 0 {
+		d.tokenChannel <- d.transport.Publish(topic, qos, false, payload)
+		return
+	}
+
+	m := offlineMessage{topic, qos, payload}
+	if len(b.messages) < b.size {
+		b.messages = append(b.messages, m)
+		b.append(m)
+		return
+	}
+	b.messages = append(b.messages[1:], m)
+	b.dropped.Add(1)
+	b.save()
+}
+
+// Publish the held messages, in order.  Stops if the connection is lost,
+// leaving the rest for next time.  Called once the device is ready.
+func (b *offlineBuffer) replay(d *Device, generation uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	n := 0
+	for ; n < len(b.messages) && d.isCurrent(generation); n++ {
+		m := b.messages[n]
+		d.tokenChannel <- d.transport.Publish(m.Topic, m.Qos, false, m.Payload)
+	}
+	if n > 0 {
+		b.messages = b.messages[n:]
+		b.save()
+	}
+}
+
+// Read the messages left in the file by an earlier run
+func (b *offlineBuffer) load() {
+	if len(b.path) == 0 {
+		return
+	}
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Offline buffer %s: %v\n", b.path, err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m offlineMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Printf("Offline buffer %s: %v\n", b.path, err)
+			continue
+		}
+		b.messages = append(b.messages, m)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Offline buffer %s: %v\n", b.path, err)
+	}
+	if len(b.messages) > b.size {
+		b.dropped.Add(uint64(len(b.messages) - b.size))
+		b.messages = b.messages[len(b.messages)-b.size:]
+		b.save()
+	}
+}
+
+// Add a message to the file
+func (b *offlineBuffer) append(m offlineMessage) {
+	if len(b.path) == 0 {
+		return
+	}
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Offline buffer %s: %v\n", b.path, err)
+		return
+	}
+	line, _ := json.Marshal(m)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Offline buffer %s: %v\n", b.path, err)
+	}
+	f.Close()
+}
+
+// Rewrite the file to hold just the messages in the buffer
+func (b *offlineBuffer) save() {
+	if len(b.path) == 0 {
+		return
+	}
+	if len(b.messages) == 0 {
+		if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Offline buffer %s: %v\n", b.path, err)
+		}
+		return
+	}
+
+	var data []byte
+	for _, m := range b.messages {
+		line, _ := json.Marshal(m)
+		data = append(append(data, line...), '\n')
+	}
+	temp := b.path + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		log.Printf("Offline buffer %s: %v\n", b.path, err)
+		return
+	}
+	if err := os.Rename(temp, b.path); err != nil {
+		log.Printf("Offline buffer %s: %v\n", b.path, err)
+	}
+}
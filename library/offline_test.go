@@ -0,0 +1,166 @@
+package homie
+
+// test the offline buffer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Records the values published to the topics that end in suffix,
+// and the $state topic, in order
+type publishLog struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *publishLog) hook(suffix string) func(topic, payload string) {
+	return func(topic, payload string) {
+		if strings.HasSuffix(topic, suffix) || strings.HasSuffix(topic, "/$state") {
+			l.mutex.Lock()
+			l.messages = append(l.messages, payload)
+			l.mutex.Unlock()
+		}
+	}
+}
+
+func (l *publishLog) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return strings.Join(l.messages, ",")
+}
+
+// The number of events the offline buffer has taken, held or dropped
+func (b *offlineBuffer) taken() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.messages) + int(b.dropped.Load())
+}
+
+// Run a device, with an offline buffer if it has one, on a flakyTransport.
+// Returns functions that send button presses, connect and lose the
+// connection, and stop the device.  Each waits for the device to act on it.
+func runOfflineDevice(t *testing.T, d *Device, l *publishLog) (func(values ...string), func(), func(), func()) {
+	f := &flakyTransport{fakeTransport: newFakeTransport()}
+	f.publishHook = l.hook("/a-node/button")
+	d.SetTransport(f)
+	p := d.NewNode("a-node", "Name a-node", "test", nil).Advertise("button", "Button", DtString)
+	stop := runTestDevice(t, d, nil)
+
+	press := func(values ...string) {
+		online := d.IsConnected() || d.offline == nil
+		published := f.publications(d.topic("a-node/button"), values[len(values)-1])
+		taken := 0
+		if !online {
+			taken = d.offline.taken()
+		}
+		for _, v := range values {
+			m := p.SetProperty()
+			m.Retained = false
+			m.Send(v)
+		}
+		waitFor(t, "the presses", func() bool {
+			if online {
+				return f.publications(d.topic("a-node/button"), values[len(values)-1]) > published
+			}
+			return d.offline.taken() == taken+len(values)
+		})
+	}
+
+	// Connecting replays the buffer
+	connect := func() {
+		f.connect(t, d)
+		if d.offline != nil {
+			waitFor(t, "the replay", func() bool { return d.offline.taken() == int(d.offline.dropped.Load()) })
+		}
+	}
+
+	// Losing the connection takes effect at once
+	lose := func() {
+		_, onLost := f.callbacks()
+		onLost(nil)
+	}
+	return press, connect, lose, stop
+}
+
+func TestOffline_Replay(t *testing.T) {
+	var l publishLog
+	d := createTestDevice()
+	d.SetOfflineBuffer(3, "")
+	press, connect, lose, stop := runOfflineDevice(t, d, &l)
+	defer d.Destroy()
+
+	connect()
+	press("a")
+	lose()
+	press("b", "c", "d", "e")
+	connect()
+	press("f")
+	stop()
+
+	// The events are sent as they were, not as the property's latest value,
+	// which the device republishes on connection
+	if s := l.String(); s != "init,,ready,a,init,e,ready,c,d,e,f,disconnected" {
+		t.Errorf("published %s", s)
+	}
+	if c := d.PublishCounters(); c.OfflineDropped != 1 {
+		t.Errorf("counters are %+v", c)
+	}
+}
+
+func TestOffline_None(t *testing.T) {
+	var l publishLog
+	d := createTestDevice()
+	press, connect, lose, stop := runOfflineDevice(t, d, &l)
+	defer d.Destroy()
+
+	connect()
+	lose()
+	press("b")
+	connect()
+	stop()
+
+	// Without a buffer, the event goes to the transport as soon as it is sent
+	if s := l.String(); s != "init,,ready,b,init,b,ready,disconnected" {
+		t.Errorf("published %s", s)
+	}
+}
+
+func TestOffline_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline")
+
+	var l1 publishLog
+	d := NewDevice("offline-device", "Offline Device")
+	d.SetTopicBase(testTopicBase)
+	d.SetOfflineBuffer(10, path)
+	press, connect, lose, stop := runOfflineDevice(t, d, &l1)
+	connect()
+	lose()
+	press("b", "c")
+	stop()
+	d.Destroy()
+	if s := l1.String(); s != "init,,ready,disconnected" {
+		t.Errorf("first run published %s", s)
+	}
+
+	// The next run replays them
+	var l2 publishLog
+	d = NewDevice("offline-device", "Offline Device")
+	d.SetTopicBase(testTopicBase)
+	d.SetOfflineBuffer(10, path)
+	_, connect, _, stop = runOfflineDevice(t, d, &l2)
+	connect()
+	stop()
+	d.Destroy()
+	if s := l2.String(); s != "init,,ready,b,c,disconnected" {
+		t.Errorf("second run published %s", s)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("offline buffer file was not removed: %v", err)
+	}
+}
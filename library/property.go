@@ -1,7 +1,10 @@
 package homie
 
 import (
-	"github.com/eclipse/paho.mqtt.golang"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
 )
 
 // Property methods
@@ -10,47 +13,176 @@ import (
 // Publication happens in Device.Run().
 
 func (p *Property) Settable(handler func(d *Device, n *Node, p *Property, value string) bool) {
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
 	p.settable = true
 	p.handler = handler
+	d.changed()
+}
+
+// The device's global handler, and the property's handler
+func (p *Property) handlers() (global, handler func(d *Device, n *Node, p *Property, value string) bool) {
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.globalHandler, p.handler
+}
+
+// The value, or the value of one index of a span
+func (p *Property) getValue(index int) string {
+	d := p.node.device
+	d.valueMutex.Lock()
+	defer d.valueMutex.Unlock()
+
+	if p.node.span {
+		return p.spanValues[index-p.node.lo]
+	}
+	return p.value
+}
+
+// The typed settable variants check each incoming "set" value against the
+// property's data type and format.  Bad values are logged and dropped.
+// Good values are parsed and passed to the handler.
+// Panics if the handler's type does not match the property's data type.
+
+func (p *Property) SettableInt(handler func(d *Device, n *Node, p *Property, value int64) bool) {
+	p.typedSettable(DtInteger, func(d *Device, n *Node, p *Property, value string) bool {
+		v, _ := strconv.ParseInt(value, 10, 64)
+		return handler(d, n, p, v)
+	})
+}
+
+func (p *Property) SettableFloat(handler func(d *Device, n *Node, p *Property, value float64) bool) {
+	p.typedSettable(DtFloat, func(d *Device, n *Node, p *Property, value string) bool {
+		v, _ := strconv.ParseFloat(value, 64)
+		return handler(d, n, p, v)
+	})
+}
+
+func (p *Property) SettableBool(handler func(d *Device, n *Node, p *Property, value bool) bool) {
+	p.typedSettable(DtBoolean, func(d *Device, n *Node, p *Property, value string) bool {
+		return handler(d, n, p, value == "true")
+	})
+}
+
+func (p *Property) SettableEnum(handler func(d *Device, n *Node, p *Property, value string) bool) {
+	p.typedSettable(DtEnum, handler)
+}
+
+func (p *Property) SettableColor(handler func(d *Device, n *Node, p *Property, value Color) bool) {
+	p.typedSettable(DtColor, func(d *Device, n *Node, p *Property, value string) bool {
+		return handler(d, n, p, parseColor(value))
+	})
+}
+
+func (p *Property) typedSettable(dataType int, handler func(d *Device, n *Node, p *Property, value string) bool) {
+	if p.dataType != dataType {
+		panic("Cannot set a " + dataTypeName(dataType) + " handler on " + dataTypeName(p.dataType) +
+			" property " + p.id + " in node " + p.node.id)
+	}
+
+	p.Settable(func(d *Device, n *Node, p *Property, value string) bool {
+		if err := p.checkValue(value); err != nil {
+			log.Printf("Rejected set: %v\n", err)
+			return false
+		}
+		return handler(d, n, p, value)
+	})
 }
 
 func (p *Property) validateUnit(unit string) string {
-	if _, ok := propertyUnits[unit]; !ok {
-		panic("invalid unit " + unit + "for property " + p.id + " in node " + p.node.id)
+	if _, ok := propertyUnits[unit]; !ok && len(unit) > 0 {
+		panic("invalid unit " + unit + " for property " + p.id + " in node " + p.node.id)
 	}
 	return unit
 }
 
+// An empty unit takes the unit away.
+// May be called on a running device, which republishes itself.
 func (p *Property) SetUnit(unit string) {
-	if p.node.device.configDone {
-		panic("Cannot setUnit on property " + p.id + " for node " + p.node.id + " to device " + p.node.device.name +
-			" after calling device.Run()")
-	}
+	unit = p.validateUnit(unit)
 
-	p.unit = p.validateUnit(unit)
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	p.unit = unit
+	d.changed()
 }
 
+// Panics if the format is not legal for the property's data type.
+// Enums and colors must have a format; the others may have it taken away.
 func (p *Property) validateFormat(format string) string {
+	if len(format) == 0 && p.dataType != DtEnum && p.dataType != DtColor {
+		p.parsedFormat = PropertyFormat{}
+		return format
+	}
+	p.parsedFormat = p.parseFormat(format)
 	return format
 }
 
+// An empty format takes the format away, except from enums and colors.
+// May be called on a running device, which republishes itself.
 func (p *Property) SetFormat(format string) {
-	if p.node.device.configDone {
-		panic("Cannot setFormat on property " + p.id + " for node " + p.node.id + " to device " + p.node.device.name +
-			" after calling device.Run()")
-	}
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 
 	p.format = p.validateFormat(format)
+	d.changed()
+}
+
+// A property that is not retained carries events, such as button presses.
+// It is advertised with $retained false, its values are sent as they
+// happen and not kept, and nothing is republished on reconnection.
+// The default is true.  May be called on a running device, which republishes itself.
+func (p *Property) SetRetained(retained bool) {
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	p.retained = retained
+	d.changed()
+}
+
+// The QoS of the messages from SetProperty() and SetSpanProperty().  The default is 1.
+func (p *Property) SetQos(qos byte) {
+	if qos > 2 {
+		panic("Invalid qos for property " + p.id + " in node " + p.node.id)
+	}
+
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	p.qos = qos
 }
 
+func (p *Property) isRetained() bool {
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return p.retained
+}
+
+// Properties of spans must use SetSpanProperty() instead.
 func (p *Property) SetProperty() PropertyMessage {
-	var m PropertyMessage
+	if p.node.span {
+		panic("Property " + p.id + " in span " + p.node.id + " requires an index")
+	}
 
-	m.Qos = 1
-	m.Retained = true
-	m.property = p
+	return p.newMessage(0)
+}
+
+// A message with the property's QoS and retained setting
+func (p *Property) newMessage(index int) PropertyMessage {
+	d := p.node.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 
-	return m
+	return PropertyMessage{property: p, Qos: p.qos, Retained: p.retained, index: index}
 }
 
 func (p *Property) topic(t string) string {
@@ -61,61 +193,73 @@ func (p *Property) publish(topic, payload string) {
 	p.node.publish(p.id+"/"+topic, payload)
 }
 
-func (p *Property) processConnect() {
-	var t string
+// The format as published under v4, which has no step, no boolean format,
+// and no formats for the data types it publishes as strings.
+func (p *Property) formatV4() string {
+	switch p.dataType {
+	case DtInteger, DtFloat:
+		if limits := strings.Split(p.format, ":"); len(limits) == 3 {
+			return limits[0] + ":" + limits[1]
+		}
+		return p.format
+	case DtEnum, DtColor:
+		return p.format
+	}
+	return ""
+}
 
+func (p *Property) processConnect() {
 	n := p.node
 
 	p.publish("$name", p.name)
+	p.publish("$datatype", dataTypeNameV4(p.dataType))
 
-	switch p.dataType {
-	case DtString:
-		t = "string"
-	case DtInteger:
-		t = "integer"
-	case DtFloat:
-		t = "float"
-	case DtBoolean:
-		t = "boolean"
-	case DtEnum:
-		t = "enum"
-	case DtColor:
-		t = "color"
-	}
-	p.publish("$datatype", t)
-
-	if len(p.format) > 0 {
-		p.publish("$format", p.format)
+	if format := p.formatV4(); len(format) > 0 {
+		p.publish("$format", format)
 	}
 
 	if p.settable {
 		p.publish("$settable", "true")
 	}
 
+	if !p.retained {
+		p.publish("$retained", "false")
+	}
+
 	if len(p.unit) > 0 {
 		p.publish("$unit", p.unit)
 	}
 
-	// Finally spit out the value of this property.
-	n.publish(p.id, p.value)
+	// Spans publish a value and subscribe to set messages per index
+	if n.span {
+		p.processConnectSpan()
+		return
+	}
 
 	// Is this property settable?  If so, subscribe to the set message.
 	d := n.device
-	d.client.Subscribe(p.topic("set"), 1, func(c mqtt.Client, msg mqtt.Message) {
-		p.setEvent(string(msg.Payload()))
+	p.subscribeSet(p.topic("set"), func(topic string, payload []byte) {
+		p.setEvent(string(payload))
 	})
+
+	// Events have no value to publish, or to recover
+	if !p.retained {
+		return
+	}
+
+	// Finally spit out the value of this property.
+	n.publish(p.id, p.getValue(0))
 	// Also subscribe to the value itself, to get the initial value
 	valueTopic := p.node.topic(p.id)
-	d.client.Subscribe(valueTopic, 1, func(c mqtt.Client, msg mqtt.Message) {
-		if !p.node.device.configDone {
-			p.setEvent(string(msg.Payload()))
+	d.transport.Subscribe(valueTopic, 1, func(topic string, payload []byte) {
+		if !p.node.device.configDone.Load() {
+			p.setEvent(string(payload))
 		}
 	})
 
 	// When we are done configuring, this fn will be called to unsubscribe the base value subscription
 	d.unsubscribes = append(d.unsubscribes, func() {
-		t := d.client.Unsubscribe(valueTopic)
-		d.tokenChannel <- &t
+		d.tokenChannel <- d.transport.Unsubscribe(valueTopic)
 	})
 }
 
@@ -123,8 +267,9 @@ func (p *Property) processConnect() {
 func (p *Property) setEvent(value string) {
 	n := p.node
 	d := n.device
+	global, handler := p.handlers()
 
-	if d.globalHandler != nil && d.globalHandler(d, n, p, value) {
+	if global != nil && global(d, n, p, value) {
 		return
 	}
 
@@ -132,31 +277,127 @@ func (p *Property) setEvent(value string) {
 		return
 	}
 
-	if p.handler != nil {
-		p.handler(d, n, p, value)
+	if handler != nil {
+		handler(d, n, p, value)
 	}
 }
 
 func (m PropertyMessage) validateValue(value string) error {
-	// TODO add checking
-	return nil
+	return m.property.checkValue(value)
 }
 
 // Returns an error if the property's value is wrong format, unit, or whatever.
-// These errors are warnings only.
+// These errors are warnings only, unless the device is in strict mode.
+// In strict mode an invalid value is neither recorded nor published.
 func (m PropertyMessage) Send(value string) error {
-	m.property.value = value
+	d := m.property.node.device
 	err := m.validateValue(value)
-	if m.property.node.device.configDone {
-		m.property.node.device.publishChannel <- m
+	if err != nil && d.strictValues.Load() {
+		return err
+	}
+
+	// Events are not kept
+	if m.property.isRetained() {
+		d.valueMutex.Lock()
+		if m.property.node.span {
+			m.property.spanValues[m.index-m.property.node.lo] = value
+		} else {
+			m.property.value = value
+		}
+		d.valueMutex.Unlock()
+	}
+
+	if d.configDone.Load() {
+		m.value = value
+		if qerr := d.publishQueue.push(m); qerr != nil {
+			return qerr
+		}
 	}
 	return err
 }
 
+// The typed senders format the value as the Homie convention requires,
+// then call Send().  They return an error without sending anything if the
+// Go type does not match the property's data type.
+
+func (m PropertyMessage) SendInt(value int64) error {
+	if err := m.checkType(DtInteger); err != nil {
+		return err
+	}
+	return m.Send(strconv.FormatInt(value, 10))
+}
+
+func (m PropertyMessage) SendFloat(value float64) error {
+	if err := m.checkType(DtFloat); err != nil {
+		return err
+	}
+	return m.Send(formatFloat(value))
+}
+
+func (m PropertyMessage) SendBool(value bool) error {
+	if err := m.checkType(DtBoolean); err != nil {
+		return err
+	}
+	return m.Send(strconv.FormatBool(value))
+}
+
+func (m PropertyMessage) SendEnum(value string) error {
+	if err := m.checkType(DtEnum); err != nil {
+		return err
+	}
+	return m.Send(value)
+}
+
+func (m PropertyMessage) SendColor(value Color) error {
+	if err := m.checkType(DtColor); err != nil {
+		return err
+	}
+	return m.Send(value.String())
+}
+
+func (m PropertyMessage) checkType(dataType int) error {
+	p := m.property
+	if p.dataType != dataType {
+		return fmt.Errorf("property %s in node %s is of type %s, not %s",
+			p.id, p.node.id, dataTypeName(p.dataType), dataTypeName(dataType))
+	}
+	return nil
+}
+
 // Called by Device.Run() to do the actual publication of a new property value.
 func (m PropertyMessage) publish() {
-	n := m.property.node
+	p := m.property
+	n := p.node
 	d := n.device
-	token := d.client.Publish(n.topic(m.property.id), m.Qos, m.Retained, m.property.value)
-	d.tokenChannel <- &token
+
+	// Events are not kept, so they carry their value, even when sent retained
+	nodeId, nodeIdV5, value := n.id, n.id, p.getValue(m.index)
+	if !m.Retained || !p.isRetained() {
+		value = m.value
+	}
+	if n.span {
+		nodeId, nodeIdV5 = n.indexId(m.index), n.indexIdV5(m.index)
+	}
+
+	if p.isRemoved() {
+		return
+	}
+
+	if d.protocols&HomieV4 != 0 {
+		m.publishTo(d.topic(nodeId+"/"+p.id), value)
+	}
+	if d.protocols&HomieV5 != 0 {
+		m.publishTo(d.topicV5(nodeIdV5+"/"+p.id), p.valueV5(value))
+	}
+}
+
+func (m PropertyMessage) publishTo(topic, value string) {
+	d := m.property.node.device
+	if m.Retained {
+		d.publishRetained(topic, m.Qos, value)
+	} else if d.offline != nil {
+		d.offline.publish(d, topic, m.Qos, value)
+	} else {
+		d.tokenChannel <- d.transport.Publish(topic, m.Qos, false, value)
+	}
 }
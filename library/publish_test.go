@@ -13,15 +13,17 @@ import (
 
 var (
 	deviceMessages = map[string]string{
-		"testing/test-device-%04d/$state":          "disconnected",
-		"testing/test-device-%04d/$homie":          "4.0.0",
-		"testing/test-device-%04d/$name":           "Test Device 0",
-		"testing/test-device-%04d/$implementation": "homieGo 0.1.0",
-		"testing/test-device-%04d/$stats/uptime":   "*",
-		"testing/test-device-%04d/$fw/name":        "unknown",
-		"testing/test-device-%04d/$extensions":     "org.homie.legacy-stats:0.1.1:[4.x],org.homie.legacy-firmware:0.1.1:[4.x]",
-		"testing/test-device-%04d/$stats/interval": "60",
-		"testing/test-device-%04d/$fw/version":     "unknown",
+		"testing/test-device-%04d/$state":                      "disconnected",
+		"testing/test-device-%04d/$homie":                      "4.0.0",
+		"testing/test-device-%04d/$name":                       "Test Device 0",
+		"testing/test-device-%04d/$implementation":             "homieGo 0.1.0",
+		"testing/test-device-%04d/$stats/uptime":               "*",
+		"testing/test-device-%04d/$fw/name":                    "unknown",
+		"testing/test-device-%04d/$extensions":                 "org.homie.legacy-stats:0.1.1:[4.x],org.homie.legacy-firmware:0.1.1:[4.x]",
+		"testing/test-device-%04d/$stats/interval":             "60",
+		"testing/test-device-%04d/$fw/version":                 "unknown",
+		"testing/test-device-%04d/$implementation/ota/enabled": "false",
+		"testing/test-device-%04d/$localip":                    "127.0.0.1",
 	}
 
 	nodeMessages = map[string]string{
@@ -39,12 +41,20 @@ var (
 func init() {
 	testTopicBase = "testing"
 	deviceCounter = 0
+
+	// The platform's default stats
+	for stat := range defaultStatsProviders() {
+		deviceMessages["testing/test-device-%04d/$stats/"+stat] = "*"
+	}
 }
 
 func createTestDevice() *Device {
 	deviceCounter += 1
 	d := NewDevice(fmt.Sprintf("test-device-%04d", deviceCounter), "Test Device 0")
 	d.SetTopicBase(testTopicBase)
+	if testBroker != nil {
+		d.SetMqttBroker(testBroker.URL())
+	}
 	return d
 }
 
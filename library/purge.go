@@ -0,0 +1,100 @@
+package homie
+
+//
+// This file contains the code to clear the retained topics of devices that
+// are gone for good, so they do not linger on the broker.
+//
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// If set, the device clears every retained topic it has published when
+// its run loop exits, rather than leaving itself $state disconnected.
+// For a device that is going away for good.  May be called while running.
+func (d *Device) SetPurgeOnExit(purge bool) {
+	d.purgeOnExit.Store(purge)
+}
+
+// Clear every retained topic the device has published
+func (d *Device) purge() {
+	d.retainedMutex.Lock()
+	topics := make([]string, 0, len(d.retained))
+	for t := range d.retained {
+		topics = append(topics, t)
+	}
+	d.retained = make(map[string]bool)
+	d.retainedMutex.Unlock()
+
+	for _, t := range topics {
+		d.tokenChannel <- d.transport.Publish(t, 1, true, "")
+	}
+}
+
+// Clear every retained topic under a device ID, under both conventions.
+// For cleaning up after devices from earlier runs that no longer exist.
+// The transport must be connected.  Retained messages are collected until
+// none has arrived for settle.  Set topics are left alone, as clearing one
+// would send the device an empty set message.
+func PurgeDevice(t Transport, topicBase, id string, settle time.Duration) error {
+	var mutex sync.Mutex
+	topics := make(map[string]bool)
+	arrived := make(chan bool, 1)
+
+	filters := []string{topicBase + "/" + id + "/#", topicBase + "/5/" + id + "/#"}
+	for _, filter := range filters {
+		token := t.Subscribe(filter, 1, func(topic string, payload []byte) {
+			if len(payload) > 0 && !strings.HasSuffix(topic, "/set") {
+				mutex.Lock()
+				topics[topic] = true
+				mutex.Unlock()
+			}
+			select {
+			case arrived <- true:
+			default:
+			}
+		})
+		token.Wait()
+		if token.Error() != nil {
+			return fmt.Errorf("Error while subscribing to %s: %w", filter, token.Error())
+		}
+	}
+
+	timer := time.NewTimer(settle)
+	for settling := true; settling; {
+		select {
+		case <-arrived:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(settle)
+		case <-timer.C:
+			settling = false
+		}
+	}
+
+	for _, filter := range filters {
+		t.Unsubscribe(filter).Wait()
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for topic := range topics {
+		if token := t.Publish(topic, 1, true, ""); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("Error while clearing %s: %w", topic, token.Error())
+		}
+	}
+	return nil
+}
+
+// Clear every retained topic of a device, whether or not the controller has seen it.
+// See PurgeDevice().  The controller must be connected.
+func (c *Controller) Purge(id string, settle time.Duration) error {
+	if !c.connected.Load() {
+		return fmt.Errorf("controller is not connected")
+	}
+	return PurgeDevice(c.transport, c.topicBase, id, settle)
+}
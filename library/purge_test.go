@@ -0,0 +1,85 @@
+package homie
+
+// test clearing the retained topics of devices that are gone
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurge_OnExit(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	d.SetProtocols(HomieV4 | HomieV5)
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+	n.Advertise("level", "Level", DtInteger).SetProperty().SendInt(3)
+
+	// Somebody else's device
+	f.Publish("testing/other-device/$state", 1, true, "ready")
+
+	waitChannel := make(chan bool, 1)
+	c, cfl := context.WithCancel(context.Background())
+	go d.RunWithContext(c, waitChannel)
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := f.retainedMessages()[d.topic("a-node/level")]; !ok {
+		t.Errorf("level was not published")
+	}
+
+	d.SetPurgeOnExit(true)
+	cfl()
+	for _ = range waitChannel {
+	}
+
+	for topic, payload := range f.retainedMessages() {
+		if strings.Contains(topic, d.id) {
+			t.Errorf("topic %s: %s was not cleared", topic, payload)
+		}
+	}
+	if len(f.retainedMessages()) != 1 {
+		t.Errorf("other device was cleared")
+	}
+}
+
+func TestPurge_Device(t *testing.T) {
+	f := newFakeTransport()
+	// true for the topics that should be cleared
+	retained := map[string]bool{
+		"testing/old-plug/$state":           true,
+		"testing/old-plug/$homie":           true,
+		"testing/old-plug/outlet/on":        true,
+		"testing/old-plug/outlet/on/$name":  true,
+		"testing/5/old-plug/$description":   true,
+		"testing/5/old-plug/outlet/on":      true,
+		"testing/old-plug/outlet/on/set":    false, // somebody retained a set message
+		"testing/old-plug-2/$state":         false,
+		"testing/5/old-plug-2/$description": false,
+		"testing/other/old-plug/$state":     false,
+		"elsewhere/old-plug/$state":         false,
+	}
+	for topic := range retained {
+		f.Publish(topic, 1, true, "x")
+	}
+
+	c := NewController(testTopicBase)
+	c.SetTransport(f)
+	if err := c.Purge("old-plug", 50*time.Millisecond); err == nil {
+		t.Errorf("purge by unconnected controller succeeded")
+	}
+	if err := c.Connect(time.Second); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := c.Purge("old-plug", 50*time.Millisecond); err != nil {
+		t.Errorf("Purge failed: %v", err)
+	}
+
+	left := f.retainedMessages()
+	for topic, cleared := range retained {
+		if _, ok := left[topic]; ok == cleared {
+			t.Errorf("topic %s cleared is %v, expected %v", topic, !ok, cleared)
+		}
+	}
+}
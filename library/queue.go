@@ -0,0 +1,181 @@
+package homie
+
+//
+// This file contains the queue of property values waiting for the run loop
+// to publish them, and the policies for when it fills.
+//
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What PropertyMessage.Send() does when the publish queue is full
+const (
+	PublishBlock      = iota // wait for room, the default
+	PublishCoalesce          // queue only the latest value of each retained property; events wait for room
+	PublishDropOldest        // make room by dropping the oldest queued value
+)
+
+// How many values may wait to be published
+const publishQueueLength = 100
+
+// Counts of the values that did not get published as sent
+type PublishCounters struct {
+	Coalesced uint64 // replaced in the queue by a later value of the property
+	Dropped   uint64 // dropped from a full queue
+	TimedOut  uint64 // refused because the queue stayed full
+
+	OfflineDropped uint64 // dropped from a full offline buffer
+}
+
+// Identifies a property, or one index of a span
+type queueKey struct {
+	property *Property
+	index    int
+}
+
+// A queued value.  The message publishes whatever the value is by then.
+type queueEntry struct {
+	message PropertyMessage
+}
+
+type publishQueue struct {
+	mutex   sync.Mutex
+	entries []*queueEntry
+	queued  map[queueKey]*queueEntry // for coalescing
+	room    chan struct{}            // closed when an entry is taken, nil if no one waits
+	ready   chan struct{}            // tells the run loop there is something to publish
+
+	policy  int
+	timeout time.Duration // for PublishBlock.  Zero waits forever.
+
+	coalesced atomic.Uint64
+	dropped   atomic.Uint64
+	timedOut  atomic.Uint64
+}
+
+func newPublishQueue() *publishQueue {
+	return &publishQueue{
+		queued: make(map[queueKey]*queueEntry),
+		ready:  make(chan struct{}, 1),
+		policy: PublishBlock,
+	}
+}
+
+// Queue a message, as the policy says.  Only PublishBlock, and events
+// under PublishCoalesce, which are never coalesced, return an error.
+func (q *publishQueue) push(m PropertyMessage) error {
+	key := queueKey{m.property, m.index}
+	coalesce := q.policy == PublishCoalesce && m.Retained && m.property.isRetained()
+	var deadline <-chan time.Time
+
+	q.mutex.Lock()
+	for {
+		if coalesce {
+			if e, ok := q.queued[key]; ok {
+				e.message = m
+				q.mutex.Unlock()
+				q.coalesced.Add(1)
+				return nil
+			}
+			break
+		}
+		if len(q.entries) < publishQueueLength {
+			break
+		}
+		if q.policy == PublishDropOldest {
+			q.entries[0] = nil
+			q.entries = q.entries[1:]
+			q.dropped.Add(1)
+			break
+		}
+
+		// PublishBlock, or an event.  Wait for the run loop to take something.
+		if q.room == nil {
+			q.room = make(chan struct{})
+		}
+		room := q.room
+		q.mutex.Unlock()
+
+		if deadline == nil && q.timeout > 0 {
+			timer := time.NewTimer(q.timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-room:
+		case <-deadline:
+			q.timedOut.Add(1)
+			return fmt.Errorf("publish queue still full after %v", q.timeout)
+		}
+		q.mutex.Lock()
+	}
+
+	e := &queueEntry{message: m}
+	q.entries = append(q.entries, e)
+	if coalesce {
+		q.queued[key] = e
+	}
+	q.mutex.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Take the oldest message.  False if there is none.
+func (q *publishQueue) pop() (PropertyMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.entries) == 0 {
+		return PropertyMessage{}, false
+	}
+	e := q.entries[0]
+	q.entries[0] = nil
+	q.entries = q.entries[1:]
+	if q.queued[queueKey{e.message.property, e.message.index}] == e {
+		delete(q.queued, queueKey{e.message.property, e.message.index})
+	}
+	if q.room != nil {
+		close(q.room)
+		q.room = nil
+	}
+	return e.message, true
+}
+
+// What Send() does when the publish queue is full: PublishBlock, PublishCoalesce,
+// or PublishDropOldest.  With PublishBlock, Send() gives up and returns an error
+// after timeout.  Zero waits forever.
+func (d *Device) SetPublishPolicy(policy int, timeout time.Duration) {
+	if d.configDone.Load() {
+		panic("Cannot set publish policy on running device " + d.id)
+	}
+	if policy != PublishBlock && policy != PublishCoalesce && policy != PublishDropOldest {
+		panic("Invalid publish policy for device " + d.id)
+	}
+	if timeout < 0 {
+		panic("Negative publish timeout for device " + d.id)
+	}
+	d.publishQueue.policy = policy
+	d.publishQueue.timeout = timeout
+}
+
+// The values that did not get published as sent, since the device was created
+func (d *Device) PublishCounters() PublishCounters {
+	q := d.publishQueue
+	c := PublishCounters{
+		Coalesced: q.coalesced.Load(),
+		Dropped:   q.dropped.Load(),
+		TimedOut:  q.timedOut.Load(),
+	}
+	if d.offline != nil {
+		c.OfflineDropped = d.offline.dropped.Load()
+	}
+	return c
+}
@@ -0,0 +1,175 @@
+package homie
+
+// test the publish queue policies
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run a device whose transport can be stalled, as during a broker outage.
+// Returns the device, its level property, and a function that ends the stall.
+func runStalledDevice(t *testing.T, policy int, timeout time.Duration) (*Device, *fakeTransport, *Property, func()) {
+	f := newFakeTransport()
+	var stalled atomic.Bool
+	inStall := make(chan bool, 1)
+	gate := make(chan bool)
+	f.publishHook = func(topic, payload string) {
+		if stalled.Load() && strings.HasSuffix(topic, "/a-node/level") {
+			select {
+			case inStall <- true:
+			default:
+			}
+			<-gate
+		}
+	}
+
+	d := createTestDevice()
+	d.SetTransport(f)
+	d.SetPublishPolicy(policy, timeout)
+	p := d.NewNode("a-node", "Name a-node", "test", nil).Advertise("level", "Level", DtInteger)
+	runTestDevice(t, d, f)
+
+	// The first value holds up the run loop
+	stalled.Store(true)
+	p.SetProperty().SendInt(0)
+	<-inStall
+
+	return d, f, p, func() { close(gate) }
+}
+
+// Wait for the level to be published after the stall
+func waitForLevel(t *testing.T, d *Device, f *fakeTransport, level string) {
+	waitFor(t, "level "+level, func() bool {
+		return f.publications(d.topic("a-node/level"), level) > 0
+	})
+}
+
+// Send values as a sensor would, and return how long it took
+func sendValues(t *testing.T, p *Property, n int) time.Duration {
+	start := time.Now()
+	for i := 1; i <= n; i++ {
+		if err := p.SetProperty().SendInt(int64(i)); err != nil {
+			t.Errorf("Send %d failed: %v", i, err)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestQueue_Coalesce(t *testing.T) {
+	d, f, p, release := runStalledDevice(t, PublishCoalesce, 0)
+
+	if took := sendValues(t, p, 1000); took > time.Second {
+		t.Errorf("sending took %v", took)
+	}
+	release()
+	waitForLevel(t, d, f, "1000")
+
+	if v := f.retainedMessages()[d.topic("a-node/level")]; v != "1000" {
+		t.Errorf("level is \"%s\", expected 1000", v)
+	}
+	if c := d.PublishCounters(); c.Coalesced != 999 || c.Dropped != 0 || c.TimedOut != 0 {
+		t.Errorf("counters are %+v", c)
+	}
+}
+
+// Events are queued in order, not coalesced
+func TestQueue_CoalesceEvents(t *testing.T) {
+	d, f, p, release := runStalledDevice(t, PublishCoalesce, 0)
+
+	var mutex sync.Mutex
+	var published []string
+	f.mutex.Lock()
+	stall := f.publishHook
+	f.publishHook = func(topic, payload string) {
+		stall(topic, payload)
+		if topic == d.topic("a-node/level") {
+			mutex.Lock()
+			published = append(published, payload)
+			mutex.Unlock()
+		}
+	}
+	f.mutex.Unlock()
+
+	for i := int64(1); i <= 10; i++ {
+		event := p.SetProperty()
+		event.Retained = false
+		event.SendInt(-i)
+		p.SetProperty().SendInt(i)
+	}
+	release()
+	waitForLevel(t, d, f, "-10")
+
+	// The retained value keeps its place in the queue, and publishes the latest
+	mutex.Lock()
+	defer mutex.Unlock()
+	if got := strings.Join(published, ","); got != "-1,10,-2,-3,-4,-5,-6,-7,-8,-9,-10" {
+		t.Errorf("published %s", got)
+	}
+	if c := d.PublishCounters(); c.Coalesced != 9 {
+		t.Errorf("counters are %+v", c)
+	}
+}
+
+func TestQueue_DropOldest(t *testing.T) {
+	d, f, p, release := runStalledDevice(t, PublishDropOldest, 0)
+
+	if took := sendValues(t, p, 1000); took > time.Second {
+		t.Errorf("sending took %v", took)
+	}
+	release()
+	waitForLevel(t, d, f, "1000")
+
+	if v := f.retainedMessages()[d.topic("a-node/level")]; v != "1000" {
+		t.Errorf("level is \"%s\", expected 1000", v)
+	}
+	if c := d.PublishCounters(); c.Dropped != 1000-publishQueueLength || c.Coalesced != 0 || c.TimedOut != 0 {
+		t.Errorf("counters are %+v", c)
+	}
+}
+
+func TestQueue_BlockTimeout(t *testing.T) {
+	d, f, p, release := runStalledDevice(t, PublishBlock, 20*time.Millisecond)
+
+	sendValues(t, p, publishQueueLength)
+	start := time.Now()
+	if err := p.SetProperty().SendInt(-1); err == nil {
+		t.Errorf("Send to a full queue succeeded")
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Send gave up after %v", waited)
+	}
+
+	// A sender waiting for room gets it once the run loop moves
+	sent := make(chan error, 1)
+	go func() {
+		sent <- p.SetProperty().SendInt(publishQueueLength + 1)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	release()
+	if err := <-sent; err != nil {
+		t.Errorf("Send after the stall failed: %v", err)
+	}
+	waitForLevel(t, d, f, "101")
+
+	if v := f.retainedMessages()[d.topic("a-node/level")]; v != "101" {
+		t.Errorf("level is \"%s\", expected 101", v)
+	}
+	if c := d.PublishCounters(); c.TimedOut != 1 || c.Coalesced != 0 || c.Dropped != 0 {
+		t.Errorf("counters are %+v", c)
+	}
+}
+
+func TestQueue_BadPolicy(t *testing.T) {
+	d := createTestDevice()
+	defer d.Destroy()
+	if err := try(func() { d.SetPublishPolicy(7, 0) }); err == nil {
+		t.Errorf("publish policy 7 was accepted")
+	}
+	if err := try(func() { d.SetPublishPolicy(PublishBlock, -time.Second) }); err == nil {
+		t.Errorf("negative timeout was accepted")
+	}
+}
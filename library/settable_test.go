@@ -0,0 +1,100 @@
+package homie
+
+// test the typed settable handlers
+
+import (
+	"testing"
+)
+
+func TestSettable_Int(t *testing.T) {
+	var got []int64
+
+	p := createValueTestProperty(DtInteger, "0:10")
+	p.SettableInt(func(d *Device, n *Node, p *Property, value int64) bool {
+		got = append(got, value)
+		return true
+	})
+
+	for _, v := range []string{"3", "banana", "11", "1.5", "10"} {
+		p.setEvent(v)
+	}
+	if len(got) != 2 || got[0] != 3 || got[1] != 10 {
+		t.Errorf("integer handler saw %v", got)
+	}
+}
+
+func TestSettable_Float(t *testing.T) {
+	var got []float64
+
+	p := createValueTestProperty(DtFloat, "")
+	p.SettableFloat(func(d *Device, n *Node, p *Property, value float64) bool {
+		got = append(got, value)
+		return true
+	})
+
+	for _, v := range []string{"-2.5", "NaN", "1e2"} {
+		p.setEvent(v)
+	}
+	if len(got) != 2 || got[0] != -2.5 || got[1] != 100 {
+		t.Errorf("float handler saw %v", got)
+	}
+}
+
+func TestSettable_Bool(t *testing.T) {
+	var got []bool
+
+	p := createValueTestProperty(DtBoolean, "")
+	p.SettableBool(func(d *Device, n *Node, p *Property, value bool) bool {
+		got = append(got, value)
+		return true
+	})
+
+	for _, v := range []string{"true", "ON", "1", "false"} {
+		p.setEvent(v)
+	}
+	if len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("boolean handler saw %v", got)
+	}
+}
+
+func TestSettable_EnumAndColor(t *testing.T) {
+	var (
+		enums  []string
+		colors []Color
+	)
+
+	p := createValueTestProperty(DtEnum, "low,high")
+	p.SettableEnum(func(d *Device, n *Node, p *Property, value string) bool {
+		enums = append(enums, value)
+		return true
+	})
+	p.setEvent("medium")
+	p.setEvent("high")
+	if len(enums) != 1 || enums[0] != "high" {
+		t.Errorf("enum handler saw %v", enums)
+	}
+
+	p = createValueTestProperty(DtColor, "hsv")
+	p.SettableColor(func(d *Device, n *Node, p *Property, value Color) bool {
+		colors = append(colors, value)
+		return true
+	})
+	p.setEvent("120,50,100")
+	p.setEvent("400,50,100")
+	if len(colors) != 1 || colors[0] != (Color{120, 50, 100}) {
+		t.Errorf("color handler saw %v", colors)
+	}
+}
+
+func TestSettable_WrongType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("boolean handler on an integer property did not panic")
+		}
+	}()
+
+	p := createValueTestProperty(DtInteger, "")
+	p.SettableBool(func(d *Device, n *Node, p *Property, value bool) bool {
+		return true
+	})
+}
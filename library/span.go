@@ -0,0 +1,135 @@
+package homie
+
+//
+// This file contains the code for spans.
+// A span is a node array: a short-hand way of describing a bunch of
+// identical nodes, indexed lo through hi.  The ESP8266 implementation
+// calls these range nodes.
+//
+// A span "relay" with indexes 1-3 is advertised as "relay[]" in $nodes.
+// Its attributes and property attributes are published under "relay",
+// its range is published in "relay/$array", and each index
+// gets its own $name and property values under "relay_1", "relay_2", ...
+//
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Create and return a span.  Properties are advertised on it just like a node.
+// Set messages for any index are passed to the handler along with the index.
+func (device *Device) NewSpan(id, name, nType string, lo, hi int,
+	handler func(d *Device, n *Node, index int, p *Property, value string) bool) *Node {
+
+	if lo < 0 || hi < lo {
+		panic(fmt.Sprintf("Invalid range %d-%d for span %s in device %s", lo, hi, id, device.name))
+	}
+
+	var node Node
+
+	node.id = validate(id, false)
+	node.name = name
+	node.nType = nType
+	node.properties = make(map[string]*Property)
+	node.device = device
+	node.span = true
+	node.lo = lo
+	node.hi = hi
+	node.spanHandler = handler
+
+	node.spanNames = make([]string, hi-lo+1)
+	for i := range node.spanNames {
+		node.spanNames[i] = name + " " + strconv.Itoa(lo+i)
+	}
+
+	device.addNode(&node)
+
+	return &node
+}
+
+func (n Node) IsSpan() bool {
+	return n.span
+}
+
+// Returns the span's index range.  Both are zero for a plain node.
+func (n Node) Range() (int, int) {
+	return n.lo, n.hi
+}
+
+// Set the friendly name of one index of a span.
+// The default is the span's name followed by the index.
+func (n *Node) SetSpanName(index int, name string) {
+	n.checkIndex(index)
+
+	d := n.device
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	n.spanNames[index-n.lo] = name
+	d.changed()
+}
+
+func (n *Node) checkIndex(index int) {
+	if !n.span {
+		panic("Node " + n.id + " in device " + n.device.name + " is not a span")
+	}
+	if index < n.lo || index > n.hi {
+		panic(fmt.Sprintf("Index %d out of range %d-%d for span %s in device %s",
+			index, n.lo, n.hi, n.id, n.device.name))
+	}
+}
+
+// The node ID used in topics for one index of a span
+func (n *Node) indexId(index int) string {
+	return n.id + "_" + strconv.Itoa(index)
+}
+
+// Returns a message to set the value of a property at one index of a span.
+func (p *Property) SetSpanProperty(index int) PropertyMessage {
+	p.node.checkIndex(index)
+
+	return p.newMessage(index)
+}
+
+// Publish the per-index attributes of a span
+func (n *Node) processConnectSpan() {
+	n.publish("$array", strconv.Itoa(n.lo)+"-"+strconv.Itoa(n.hi))
+	for i := n.lo; i <= n.hi; i++ {
+		n.device.publish(n.indexId(i)+"/$name", n.spanNames[i-n.lo])
+	}
+}
+
+// Publish the values of a span property and subscribe to its set messages
+func (p *Property) processConnectSpan() {
+	n := p.node
+	d := n.device
+
+	for i := n.lo; i <= n.hi; i++ {
+		index := i
+		if p.retained {
+			d.publish(n.indexId(index)+"/"+p.id, p.getValue(index))
+		}
+		p.subscribeSet(d.topic(n.indexId(index)+"/"+p.id+"/set"), func(topic string, payload []byte) {
+			p.setSpanEvent(index, string(payload))
+		})
+	}
+}
+
+// When a "set" message is received for a span, this executes in some random go routine context.
+func (p *Property) setSpanEvent(index int, value string) {
+	n := p.node
+	d := n.device
+	global, handler := p.handlers()
+
+	if global != nil && global(d, n, p, value) {
+		return
+	}
+
+	if n.spanHandler != nil && n.spanHandler(d, n, index, p, value) {
+		return
+	}
+
+	if handler != nil {
+		handler(d, n, p, value)
+	}
+}
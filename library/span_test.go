@@ -0,0 +1,77 @@
+package homie
+
+// test spans
+
+import (
+	"testing"
+)
+
+func TestSpan_Values(t *testing.T) {
+	d := createTestDevice()
+	n := d.NewSpan("relay", "Relay", "test", 1, 3, nil)
+	p := n.Advertise("on", "On", DtBoolean)
+
+	if !n.IsSpan() {
+		t.Errorf("span does not report itself as a span")
+	}
+	if lo, hi := n.Range(); lo != 1 || hi != 3 {
+		t.Errorf("span range is %d-%d", lo, hi)
+	}
+
+	p.SetSpanProperty(1).SendBool(true)
+	p.SetSpanProperty(3).Send("false")
+	if p.spanValues[0] != "true" || p.spanValues[1] != "" || p.spanValues[2] != "false" {
+		t.Errorf("span values are %v", p.spanValues)
+	}
+
+	n.SetSpanName(2, "Middle relay")
+	if n.spanNames[0] != "Relay 1" || n.spanNames[1] != "Middle relay" {
+		t.Errorf("span names are %v", n.spanNames)
+	}
+	if n.indexId(2) != "relay_2" {
+		t.Errorf("index 2 has id %s", n.indexId(2))
+	}
+}
+
+func TestSpan_SetEvent(t *testing.T) {
+	var (
+		gotIndex int
+		gotValue string
+	)
+
+	d := createTestDevice()
+	n := d.NewSpan("relay", "Relay", "test", 0, 7,
+		func(d *Device, n *Node, index int, p *Property, value string) bool {
+			gotIndex = index
+			gotValue = value
+			return true
+		})
+	p := n.Advertise("on", "On", DtBoolean)
+
+	p.setSpanEvent(3, "true")
+	if gotIndex != 3 || gotValue != "true" {
+		t.Errorf("span handler saw index %d value %s", gotIndex, gotValue)
+	}
+}
+
+func TestSpan_BadIndex(t *testing.T) {
+	d := createTestDevice()
+	n := d.NewSpan("relay", "Relay", "test", 1, 3, nil)
+	p := n.Advertise("on", "On", DtBoolean)
+
+	for _, f := range []func(){
+		func() { p.SetSpanProperty(0) },
+		func() { p.SetSpanProperty(4) },
+		func() { p.SetProperty() },
+		func() { d.NewSpan("backwards", "Backwards", "test", 3, 1, nil) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("bad span use did not panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -0,0 +1,82 @@
+package homie
+
+//
+// This file contains the code for the legacy-stats extension.
+// Uptime is always published.  The optional stats are published
+// for each stat that has a provider.
+//
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// The optional stats of the legacy-stats extension
+const (
+	StatSignal   = "signal"   // signal strength, in %
+	StatCpuTemp  = "cputemp"  // CPU temperature, in °C
+	StatCpuLoad  = "cpuload"  // CPU load, in %, over the last interval
+	StatBattery  = "battery"  // battery level, in %
+	StatFreeHeap = "freeheap" // free memory, in bytes
+	StatSupply   = "supply"   // supply voltage, in V
+)
+
+// Which stats are published as floats rather than integers
+var statIsFloat = map[string]bool{
+	StatSignal:   false,
+	StatCpuTemp:  true,
+	StatCpuLoad:  false,
+	StatBattery:  false,
+	StatFreeHeap: false,
+	StatSupply:   true,
+}
+
+// Set how often the stats are published.  The default is 60 seconds.
+func (d *Device) SetStatsInterval(interval time.Duration) {
+	if d.configDone.Load() {
+		panic("Cannot set stats interval on running device " + d.id)
+	}
+	if interval < time.Second {
+		panic("Stats interval for device " + d.id + " must be at least one second")
+	}
+	d.statsInterval = interval
+}
+
+// Supply one of the optional stats.  The provider is called from the run loop
+// each stats interval, and must not block.  If it returns false, the stat is not
+// published that time.  A nil provider stops the stat being published.
+// On Linux, cpuload and freeheap are provided from /proc unless replaced.
+func (d *Device) SetStatsProvider(stat string, provider func() (float64, bool)) {
+	if _, ok := statIsFloat[stat]; !ok {
+		panic("Unknown stat " + stat + " for device " + d.id)
+	}
+	if d.configDone.Load() {
+		panic("Cannot set stats provider on running device " + d.id)
+	}
+	if provider == nil {
+		delete(d.statsProviders, stat)
+	} else {
+		d.statsProviders[stat] = provider
+	}
+}
+
+// Publish uptime and the optional stats
+func (d *Device) publishStats() {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+
+	d.publish("$stats/uptime", durationToSeconds(time.Since(d.statsBootTime)))
+
+	for stat, provider := range d.statsProviders {
+		v, ok := provider()
+		if !ok {
+			continue
+		}
+		if statIsFloat[stat] {
+			d.publish("$stats/"+stat, formatFloat(v))
+		} else {
+			d.publish("$stats/"+stat, strconv.FormatInt(int64(math.Round(v)), 10))
+		}
+	}
+}
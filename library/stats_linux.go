@@ -0,0 +1,86 @@
+package homie
+
+//
+// This file contains the Linux default stats providers, which read /proc.
+//
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func defaultStatsProviders() map[string]func() (float64, bool) {
+	return map[string]func() (float64, bool){
+		StatCpuLoad:  cpuLoadProvider(),
+		StatFreeHeap: freeMemory,
+	}
+}
+
+// Returns a provider of the percentage of time the CPUs were busy since the last call
+func cpuLoadProvider() func() (float64, bool) {
+	var lastBusy, lastTotal uint64
+
+	return func() (float64, bool) {
+		busy, total, ok := cpuTimes()
+		if !ok || total <= lastTotal {
+			return 0, false
+		}
+		load := 100 * float64(busy-lastBusy) / float64(total-lastTotal)
+		lastBusy, lastTotal = busy, total
+		return load, true
+	}
+}
+
+// Reads the busy and total time of all CPUs from the first line of /proc/stat:
+// cpu user nice system idle iowait irq softirq steal ...
+func cpuTimes() (busy, total uint64, ok bool) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, 0, false
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, false
+	}
+	for i, field := range fields[1:] {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total += n
+		if i != 3 && i != 4 { // idle and iowait
+			busy += n
+		}
+	}
+	return busy, total, true
+}
+
+// Reads MemAvailable from /proc/meminfo, in bytes
+func freeMemory() (float64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return float64(kb * 1024), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,15 @@
+package homie
+
+import (
+	"testing"
+)
+
+func TestStats_LinuxProviders(t *testing.T) {
+	load := cpuLoadProvider()
+	if v, ok := load(); !ok || v < 0 || v > 100 {
+		t.Errorf("cpu load is %v, %v", v, ok)
+	}
+	if v, ok := freeMemory(); !ok || v <= 0 {
+		t.Errorf("free memory is %v, %v", v, ok)
+	}
+}
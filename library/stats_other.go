@@ -0,0 +1,8 @@
+//go:build !linux
+
+package homie
+
+// There are no default stats providers off Linux
+func defaultStatsProviders() map[string]func() (float64, bool) {
+	return make(map[string]func() (float64, bool))
+}
@@ -0,0 +1,114 @@
+package homie
+
+// test the publication of stats
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats_Publication(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	createTestNode(d, "a-node")
+	d.SetStatsProvider(StatBattery, func() (float64, bool) { return 87.4, true })
+	d.SetStatsProvider(StatSupply, func() (float64, bool) { return 3.3, true })
+	d.SetStatsProvider(StatSignal, func() (float64, bool) { return 0, false })
+	d.SetStatsProvider(StatCpuLoad, nil)
+	d.SetStatsProvider(StatFreeHeap, nil)
+	d.statsInterval = 50 * time.Millisecond // too short to set legally
+
+	var mutex sync.Mutex
+	uptimes := 0
+	f.publishHook = func(topic, payload string) {
+		if topic == d.topic("$stats/uptime") {
+			mutex.Lock()
+			uptimes++
+			mutex.Unlock()
+		}
+	}
+
+	c, cfl := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	d.RunWithContext(c, make(chan bool, 1))
+	cfl()
+
+	mutex.Lock()
+	if uptimes < 2 {
+		t.Errorf("uptime published %d times", uptimes)
+	}
+	mutex.Unlock()
+
+	retained := f.retainedMessages()
+	expected := map[string]string{
+		"$stats/battery": "87",
+		"$stats/supply":  "3.3",
+	}
+	for k, v := range expected {
+		if v2 := retained[d.topic(k)]; v2 != v {
+			t.Errorf("%s is \"%s\", expected \"%s\"", k, v2, v)
+		}
+	}
+	for _, k := range []string{"$stats/signal", "$stats/cpuload", "$stats/freeheap"} {
+		if v, ok := retained[d.topic(k)]; ok {
+			t.Errorf("did not expect %s: %s", k, v)
+		}
+	}
+}
+
+func TestStats_Configuration(t *testing.T) {
+	d := createTestDevice()
+
+	expectPanic := func(what string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", what)
+			}
+		}()
+		f()
+	}
+	expectPanic("short interval", func() { d.SetStatsInterval(time.Millisecond) })
+	expectPanic("unknown stat", func() { d.SetStatsProvider("humidity", nil) })
+
+	d.SetStatsInterval(5 * time.Minute)
+	if d.statsInterval != 5*time.Minute {
+		t.Errorf("stats interval is %v", d.statsInterval)
+	}
+}
+
+// A provider may send property values itself
+func TestStats_ProviderSends(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	p := d.NewNode("sensor", "Sensor", "test", nil).Advertise("level", "Level", DtInteger)
+	d.SetStatsProvider(StatBattery, func() (float64, bool) {
+		p.SetProperty().SendInt(42)
+		return 90, true
+	})
+
+	ready := make(chan bool, 1)
+	f.publishHook = func(topic, payload string) {
+		if topic == d.topic("$state") && payload == "ready" {
+			ready <- true
+		}
+	}
+
+	waitChannel := make(chan bool, 1)
+	c, cfl := context.WithCancel(context.Background())
+	go d.RunWithContext(c, waitChannel)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatalf("device did not get ready")
+	}
+	cfl()
+	for _ = range waitChannel {
+	}
+
+	if v := f.retainedMessages()[d.topic("sensor/level")]; v != "42" {
+		t.Errorf("level is \"%s\"", v)
+	}
+}
@@ -0,0 +1,110 @@
+package homie
+
+//
+// This file contains the options for a secured connection to the broker:
+// credentials, and TLS for ssl://, tls://, and mqtts:// brokers.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// The usual ways of setting up TLS, from files.  All fields are optional.
+type TLSOptions struct {
+	CAFile             string // PEM certificates to trust, rather than the system's
+	CertFile           string // PEM client certificate, with KeyFile
+	KeyFile            string
+	ServerName         string // if the broker's certificate is not for the name in the broker URL
+	InsecureSkipVerify bool   // accept any certificate.  For labs only
+}
+
+func (o TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if len(o.CAFile) > 0 {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + o.CAFile)
+		}
+	}
+
+	if len(o.CertFile) > 0 || len(o.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// Security settings for the default transport
+type brokerSecurity struct {
+	username  string
+	password  string
+	tlsConfig *tls.Config
+}
+
+func (s brokerSecurity) apply(t *PahoTransport) {
+	if len(s.username) > 0 {
+		t.Options().SetUsername(s.username)
+		t.Options().SetPassword(s.password)
+	}
+	if s.tlsConfig != nil {
+		t.Options().SetTLSConfig(s.tlsConfig)
+	}
+}
+
+func (s brokerSecurity) applyV5(t *PahoV5Transport) {
+	if len(s.username) > 0 {
+		t.Config().ConnectUsername = s.username
+		t.Config().ConnectPassword = []byte(s.password)
+	}
+	if s.tlsConfig != nil {
+		t.Config().TlsCfg = s.tlsConfig
+	}
+}
+
+// Log in to the broker.  Not used with a transport set with SetTransport().
+func (d *Device) SetMqttCredentials(username, password string) {
+	if d.configDone.Load() {
+		panic("Cannot set mqtt credentials on running device " + d.id)
+	}
+	d.security.username = username
+	d.security.password = password
+}
+
+// The TLS configuration for ssl://, tls://, and mqtts:// brokers.  See TLSOptions.
+// Not used with a transport set with SetTransport().
+func (d *Device) SetTLSConfig(c *tls.Config) {
+	if d.configDone.Load() {
+		panic("Cannot set TLS config on running device " + d.id)
+	}
+	d.security.tlsConfig = c
+}
+
+func (c *Controller) SetMqttCredentials(username, password string) {
+	if c.connected.Load() {
+		panic("Cannot set mqtt credentials on connected controller")
+	}
+	c.security.username = username
+	c.security.password = password
+}
+
+func (c *Controller) SetTLSConfig(config *tls.Config) {
+	if c.connected.Load() {
+		panic("Cannot set TLS config on connected controller")
+	}
+	c.security.tlsConfig = config
+}
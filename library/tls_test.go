@@ -0,0 +1,150 @@
+package homie
+
+// test connecting to a broker over TLS, with credentials
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/duke1swd/homieGo/broker"
+)
+
+// Write a self-signed certificate for 127.0.0.1, and its key, to a temporary directory
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test broker"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+// Start a broker that speaks TLS and wants a username and password.  Returns its URL.
+func startTLSBroker(t *testing.T, certFile, keyFile string) string {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair failed: %v", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	b := broker.New()
+	b.SetAuthenticator(func(clientID, username, password string) bool {
+		return username == "homie" && password == "secret"
+	})
+	go b.Serve(l)
+	t.Cleanup(func() { b.Close() })
+	return "ssl://" + l.Addr().String()
+}
+
+func TestTLS_Options(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	c, err := TLSOptions{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "broker"}.Config()
+	if err != nil {
+		t.Fatalf("Config failed: %v", err)
+	}
+	if c.RootCAs == nil || len(c.Certificates) != 1 || c.ServerName != "broker" {
+		t.Errorf("Config did not set up the CA, client certificate, and server name")
+	}
+
+	if _, err := (TLSOptions{CAFile: keyFile}).Config(); err == nil {
+		t.Errorf("a key was accepted as a CA certificate")
+	}
+	if _, err := (TLSOptions{CertFile: certFile}).Config(); err == nil {
+		t.Errorf("a client certificate without a key was accepted")
+	}
+	if _, err := (TLSOptions{CAFile: filepath.Join(t.TempDir(), "none.pem")}).Config(); err == nil {
+		t.Errorf("a missing CA file was accepted")
+	}
+}
+
+func TestTLS_Connect(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	url := startTLSBroker(t, certFile, keyFile)
+
+	tlsConfig, err := TLSOptions{CAFile: certFile}.Config()
+	if err != nil {
+		t.Fatalf("Config failed: %v", err)
+	}
+
+	d := createTestDevice()
+	d.SetMqttBroker(url)
+	d.SetMqttCredentials("homie", "secret")
+	d.SetTLSConfig(tlsConfig)
+	d.NewNode("a-node", "Name a-node", "test", nil)
+
+	waitChannel := make(chan bool, 1)
+	ctx, cfl := context.WithCancel(context.Background())
+	go d.RunWithContext(ctx, waitChannel)
+	defer func() {
+		cfl()
+		for _ = range waitChannel {
+		}
+		d.Destroy()
+	}()
+
+	// A controller without the password is turned away
+	c := NewController(testTopicBase)
+	c.SetMqttBroker(url)
+	c.SetMqttCredentials("homie", "guess")
+	c.SetTLSConfig(tlsConfig)
+	if err := c.Connect(time.Second); err == nil {
+		t.Errorf("controller connected with the wrong password")
+		c.Disconnect()
+	}
+
+	c = NewController(testTopicBase)
+	c.SetMqttBroker(url)
+	c.SetMqttCredentials("homie", "secret")
+	c.SetTLSConfig(tlsConfig)
+	if err := c.Connect(time.Second); err != nil {
+		t.Fatalf("controller Connect failed: %v", err)
+	}
+	defer c.Disconnect()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(20 * time.Millisecond) {
+		if cd := c.Device(d.id); cd != nil && cd.State() == "ready" {
+			return
+		}
+	}
+	t.Errorf("device did not reach ready over TLS")
+}
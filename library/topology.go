@@ -0,0 +1,97 @@
+package homie
+
+//
+// This file contains the code for changing the nodes and properties of a running device.
+//
+// A change marks the device for reconfiguration.  On its next pass, the run loop
+// goes through the convention's cycle: $state init, republish everything, $state ready.
+// The device remembers the retained topics it has published, and the cycle clears
+// any it did not publish again: those of removed nodes and properties, formats and
+// units that were taken away, and so on.
+//
+
+// Note a change to the nodes or properties.  Must hold d.mutex.
+func (d *Device) changed() {
+	if d.configDone.Load() {
+		d.reconfigure.Store(true)
+		d.wake()
+	}
+}
+
+// Stop listening for set messages to a removed property
+func (p *Property) remove() {
+	d := p.node.device
+
+	d.mutex.Lock()
+	p.removed = true
+	topics := p.setTopics
+	p.setTopics = nil
+	d.mutex.Unlock()
+
+	for _, t := range topics {
+		d.tokenChannel <- d.transport.Unsubscribe(t)
+	}
+}
+
+func (p *Property) isRemoved() bool {
+	d := p.node.device
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return p.removed
+}
+
+// Subscribe to one of the property's set topics.  Must hold d.mutex.
+func (p *Property) subscribeSet(topic string, handler func(topic string, payload []byte)) {
+	p.node.device.transport.Subscribe(topic, 1, handler)
+
+	for _, t := range p.setTopics {
+		if t == topic {
+			return
+		}
+	}
+	p.setTopics = append(p.setTopics, topic)
+}
+
+// Publish a retained message, remembering the topic so it can be cleared
+// once the device no longer publishes it.
+func (d *Device) publishRetained(topic string, qos byte, payload string) {
+	d.retainedMutex.Lock()
+	if len(payload) == 0 {
+		delete(d.retained, topic)
+	} else {
+		d.retained[topic] = true
+		if d.republished != nil {
+			d.republished[topic] = true
+		}
+	}
+	d.retainedMutex.Unlock()
+
+	d.tokenChannel <- d.transport.Publish(topic, qos, true, payload)
+}
+
+// Start tracking what processConnect() publishes
+func (d *Device) startRepublish() {
+	d.retainedMutex.Lock()
+	defer d.retainedMutex.Unlock()
+
+	d.republished = make(map[string]bool)
+}
+
+// Clear the retained topics published before, but not by this processConnect()
+func (d *Device) clearStale() {
+	d.retainedMutex.Lock()
+	stale := make([]string, 0)
+	for t := range d.retained {
+		if !d.republished[t] {
+			stale = append(stale, t)
+			delete(d.retained, t)
+		}
+	}
+	d.republished = nil
+	d.retainedMutex.Unlock()
+
+	for _, t := range stale {
+		d.tokenChannel <- d.transport.Publish(t, 1, true, "")
+	}
+}
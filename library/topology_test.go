@@ -0,0 +1,140 @@
+package homie
+
+// test changes to the nodes and properties of a running device
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopology_Changes(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	a := d.NewNode("a-node", "Name a-node", "test", nil)
+	level := a.Advertise("level", "Level", DtInteger)
+	sets := make(chan string, 10)
+	level.Settable(func(d *Device, n *Node, p *Property, value string) bool {
+		sets <- value
+		return true
+	})
+	temperature := a.Advertise("temperature", "Temperature", DtFloat)
+	temperature.SetUnit("°C")
+
+	states := make(chan string, 20)
+	f.publishHook = func(topic, payload string) {
+		if topic == d.topic("$state") {
+			states <- payload
+		}
+	}
+	expectCycle := func(what string) {
+		for _, expected := range []string{"init", "ready"} {
+			select {
+			case s := <-states:
+				if s != expected {
+					t.Fatalf("%s: $state is %s, expected %s", what, s, expected)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: no $state %s", what, expected)
+			}
+		}
+	}
+
+	waitChannel := make(chan bool, 1)
+	c, cfl := context.WithCancel(context.Background())
+	go d.RunWithContext(c, waitChannel)
+	expectCycle("connect")
+
+	// Add a node and change a unit
+	b := d.NewNode("b-node", "Name b-node", "test", nil)
+	b.Advertise("count", "Count", DtInteger).SetProperty().SendInt(7)
+	temperature.SetUnit("°F")
+	expectCycle("add")
+
+	retained := f.retainedMessages()
+	expected := map[string]string{
+		"$nodes":                   "a-node,b-node",
+		"b-node/$name":             "Name b-node",
+		"b-node/$properties":       "count",
+		"b-node/count/$datatype":   "integer",
+		"b-node/count":             "7",
+		"a-node/temperature/$unit": "°F",
+		"a-node/$properties":       "level,temperature",
+		"a-node/level/$settable":   "true",
+	}
+	for k, v := range expected {
+		if v2 := retained[d.topic(k)]; v != v2 && !sameList(d.topic(k), v, v2) {
+			t.Errorf("%s is \"%s\", expected \"%s\"", k, v2, v)
+		}
+	}
+
+	// Take away a format and a unit
+	level.SetFormat("0:10")
+	expectCycle("add format")
+	level.SetFormat("")
+	temperature.SetUnit("")
+	expectCycle("take away format and unit")
+	for _, k := range []string{"a-node/level/$format", "a-node/temperature/$unit"} {
+		if v, ok := f.retainedMessages()[d.topic(k)]; ok {
+			t.Errorf("%s is \"%s\", expected it cleared", k, v)
+		}
+	}
+
+	// Remove a property, then a node
+	a.RemoveProperty("temperature")
+	expectCycle("remove property")
+	if v := f.retainedMessages()[d.topic("a-node/$properties")]; v != "level" {
+		t.Errorf("$properties is \"%s\"", v)
+	}
+
+	f.Publish(d.topic("a-node/level/set"), 1, false, "3")
+	select {
+	case v := <-sets:
+		if v != "3" {
+			t.Errorf("set %s", v)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("set before removal was not received")
+	}
+
+	d.RemoveNode("a-node")
+	expectCycle("remove node")
+
+	for topic := range f.retainedMessages() {
+		if strings.HasPrefix(topic, d.topic("a-node")) {
+			t.Errorf("topic %s was not cleared", topic)
+		}
+	}
+	if v := f.retainedMessages()[d.topic("$nodes")]; v != "b-node" {
+		t.Errorf("$nodes is \"%s\"", v)
+	}
+
+	f.Publish(d.topic("a-node/level/set"), 1, false, "4")
+	select {
+	case v := <-sets:
+		t.Errorf("removed property received set %s", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cfl()
+	for _ = range waitChannel {
+	}
+}
+
+func TestTopology_RemoveUnknown(t *testing.T) {
+	d := createTestDevice()
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+
+	expectPanic := func(what string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", what)
+			}
+		}()
+		f()
+	}
+	expectPanic("unknown node", func() { d.RemoveNode("b-node") })
+	expectPanic("unknown property", func() { n.RemoveProperty("level") })
+}
@@ -0,0 +1,53 @@
+package homie
+
+//
+// This file contains the interface between devices (and controllers)
+// and the MQTT client library.  The paho client is the default.
+// Plug in another transport with Device.SetTransport(), for example to
+// use another client, to wrap a transport with logging, or to test
+// a device without a broker.
+//
+
+import (
+	"net"
+	"time"
+)
+
+// Tracks the completion of an operation.  paho's mqtt.Token satisfies this.
+type Token interface {
+	Wait() bool                     // blocks until the operation is complete
+	WaitTimeout(time.Duration) bool // returns false if the timeout expires first
+	Done() <-chan struct{}          // closed when the operation is complete
+	Error() error                   // nil if the operation succeeded
+}
+
+// The message the broker publishes if the connection is lost
+type Will struct {
+	Topic    string
+	Payload  string
+	Qos      byte
+	Retained bool
+}
+
+type Transport interface {
+	// Start connecting to the broker.  The transport is expected to reconnect
+	// on its own.  onConnect is called each time the connection is made,
+	// and onLost each time it is lost.  Neither may block.
+	Connect(will *Will, onConnect func(), onLost func(err error)) Token
+
+	Publish(topic string, qos byte, retained bool, payload string) Token
+
+	// The handler is called out of the transport's own go routine.
+	Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) Token
+
+	Unsubscribe(topic string) Token
+
+	// Disconnect, waiting up to quiesce for pending work to complete.
+	Disconnect(quiesce time.Duration)
+}
+
+// Transports that know the local address they reach the broker from implement this.
+// Devices publish it as $localip, and the MAC of its interface as $mac.
+type LocalAddresser interface {
+	LocalAddr() net.IP // nil if not known
+}
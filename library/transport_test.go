@@ -0,0 +1,439 @@
+package homie
+
+// A transport for testing devices without a broker, and tests that use it.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duke1swd/homieGo/broker"
+)
+
+// A token that is already complete
+type doneToken struct {
+	err error
+}
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                   { return t.err }
+func (t doneToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// Acts like a connection to a broker with no other clients
+type fakeTransport struct {
+	mutex         sync.Mutex
+	retained      map[string]string
+	subscriptions map[string]func(topic string, payload []byte)
+	will          *Will
+	publishHook   func(topic, payload string) // if set, called on every publish
+	published     map[[2]string]int           // how often each topic and payload was published
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		retained:      make(map[string]string),
+		subscriptions: make(map[string]func(topic string, payload []byte)),
+		published:     make(map[[2]string]int),
+	}
+}
+
+func (f *fakeTransport) Connect(will *Will, onConnect func(), onLost func(err error)) Token {
+	f.will = will
+	go onConnect()
+	return doneToken{}
+}
+
+func (f *fakeTransport) Publish(topic string, qos byte, retained bool, payload string) Token {
+	f.mutex.Lock()
+	f.published[[2]string{topic, payload}]++
+	if retained {
+		if len(payload) == 0 {
+			delete(f.retained, topic)
+		} else {
+			f.retained[topic] = payload
+		}
+	}
+	hook := f.publishHook
+	for filter, handler := range f.subscriptions {
+		if broker.FilterMatches(filter, topic) {
+			go handler(topic, []byte(payload))
+		}
+	}
+	f.mutex.Unlock()
+
+	if hook != nil {
+		hook(topic, payload)
+	}
+	return doneToken{}
+}
+
+func (f *fakeTransport) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) Token {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.subscriptions[topic] = handler
+	for t, payload := range f.retained {
+		if broker.FilterMatches(topic, t) {
+			go handler(t, []byte(payload))
+		}
+	}
+	return doneToken{}
+}
+
+func (f *fakeTransport) Unsubscribe(topic string) Token {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.subscriptions, topic)
+	return doneToken{}
+}
+
+func (f *fakeTransport) Disconnect(quiesce time.Duration) {
+}
+
+// Reaches the broker over loopback, so there is no MAC
+func (f *fakeTransport) LocalAddr() net.IP {
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// Returns a copy of the retained messages
+func (f *fakeTransport) retainedMessages() map[string]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r := make(map[string]string)
+	for k, v := range f.retained {
+		r[k] = v
+	}
+	return r
+}
+
+// The number of times payload has been published to topic
+func (f *fakeTransport) publications(topic, payload string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.published[[2]string{topic, payload}]
+}
+
+// Wait for what the device has published to satisfy cond.
+// Fails the test after five seconds.
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// Run a device until the test ends, or stop is called.  Returns once it has
+// published $state ready on f, the fakeTransport it was given or the one
+// its transport embeds.  With a nil f, the test makes the connection.
+func runTestDevice(tb testing.TB, d *Device, f *fakeTransport) (stop func()) {
+	waitChannel := make(chan bool, 1)
+	c, cfl := context.WithCancel(context.Background())
+	go d.RunWithContext(c, waitChannel)
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cfl()
+			for _ = range waitChannel {
+			}
+		})
+	}
+	tb.Cleanup(func() {
+		stop()
+		d.Destroy()
+	})
+
+	if f != nil {
+		waitFor(tb, d.id+" to be ready", func() bool {
+			return f.publications(d.topic("$state"), "ready") > 0
+		})
+	}
+	return stop
+}
+
+func TestTransport_Publication(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	createTestNode(d, "a-node")
+	createTestNode(d, "another-node")
+
+	c, cfl := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	d.RunWithContext(c, make(chan bool, 1))
+	cfl()
+
+	if f.will == nil || f.will.Topic != "testing/"+d.id+"/$state" || f.will.Payload != "lost" {
+		t.Errorf("will is %+v", f.will)
+	}
+
+	expected := dmSub(deviceMessages, deviceCounter)
+	for k, v := range dmSub(nodeMessages, deviceCounter) {
+		expected[k] = v
+	}
+	retained := f.retainedMessages()
+	for k, v := range expected {
+		if v2, ok := retained[k]; !ok {
+			t.Errorf("Did not find topic %s", k)
+		} else if v != "*" && v != v2 && !sameList(k, v, v2) {
+			t.Errorf("For topic %s expected value \"%s\" found value \"%s\"", k, v, v2)
+		}
+	}
+}
+
+func TestTransport_Set(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+	p := n.Advertise("level", "Level", DtInteger)
+	p.SettableInt(func(d *Device, n *Node, p *Property, value int64) bool {
+		p.SetProperty().SendInt(value * 2)
+		return true
+	})
+
+	runTestDevice(t, d, f)
+	f.Publish("testing/"+d.id+"/a-node/level/set", 1, false, "21")
+	waitFor(t, "level 42", func() bool {
+		return f.retainedMessages()["testing/"+d.id+"/a-node/level"] == "42"
+	})
+}
+
+// A fakeTransport whose connection the test makes and breaks
+type flakyTransport struct {
+	*fakeTransport
+	onConnect func()
+	onLost    func(err error)
+}
+
+func (f *flakyTransport) Connect(will *Will, onConnect func(), onLost func(err error)) Token {
+	f.mutex.Lock()
+	f.will = will
+	f.onConnect = onConnect
+	f.onLost = onLost
+	f.mutex.Unlock()
+	return doneToken{}
+}
+
+func (f *flakyTransport) callbacks() (func(), func(err error)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.onConnect, f.onLost
+}
+
+// Make the connection, once the device has tried to, and wait for the
+// device to be ready on it
+func (f *flakyTransport) connect(tb testing.TB, d *Device) {
+	var onConnect func()
+	waitFor(tb, d.id+" to try to connect", func() bool {
+		onConnect, _ = f.callbacks()
+		return onConnect != nil
+	})
+	n := f.publications(d.topic("$state"), "ready")
+	onConnect()
+	waitFor(tb, d.id+" to be ready", func() bool {
+		return f.publications(d.topic("$state"), "ready") > n
+	})
+}
+
+// Connect and disconnect over and over while a handler sends values.
+// Run with -race.
+func TestTransport_Reconnect(t *testing.T) {
+	f := &flakyTransport{fakeTransport: newFakeTransport()}
+	d := createTestDevice()
+	d.SetTransport(f)
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+	p := n.Advertise("level", "Level", DtInteger)
+	d.SetStatsInterval(time.Second)
+
+	stop := runTestDevice(t, d, nil)
+	f.connect(t, d)
+	onConnect, onLost := f.callbacks()
+
+	sent := make(chan bool)
+	go func() {
+		for i := int64(0); i < 500; i++ {
+			p.SetProperty().SendInt(i)
+		}
+		sent <- true
+	}()
+	for i := 0; i < 200; i++ {
+		onConnect()
+		if i%3 == 0 {
+			time.Sleep(time.Duration(i%5) * 100 * time.Microsecond)
+		}
+		onLost(nil)
+	}
+	<-sent
+	f.connect(t, d)
+	waitFor(t, "the last level", func() bool {
+		return f.retainedMessages()["testing/"+d.id+"/a-node/level"] == "499"
+	})
+	stop()
+
+	retained := f.retainedMessages()
+	if v := retained["testing/"+d.id+"/$state"]; v != "disconnected" {
+		t.Errorf("state is \"%s\", expected disconnected", v)
+	}
+}
+
+// A message sent retained on an event property publishes its own value
+// Formats and units change while values are sent, set, and published.  Run with -race.
+func TestTransport_FormatRace(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	d.SetProtocols(HomieV4 | HomieV5)
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+	level := n.Advertise("level", "Level", DtInteger)
+	level.SetFormat("0:100")
+	level.SettableInt(func(d *Device, n *Node, p *Property, value int64) bool {
+		p.SetProperty().SendInt(value)
+		return true
+	})
+	color := n.Advertise("color", "Color", DtColor)
+	color.SetFormat("rgb")
+	color.SettableColor(func(d *Device, n *Node, p *Property, value Color) bool {
+		p.SetProperty().SendColor(value)
+		return true
+	})
+	runTestDevice(t, d, f)
+
+	sent := make(chan bool)
+	go func() {
+		for i := int64(0); i < 200; i++ {
+			level.SetProperty().SendInt(i % 100)
+			color.SetProperty().SendColor(Color{1, 2, 3})
+			f.Publish("testing/"+d.id+"/a-node/level/set", 1, false, "50")
+			f.Publish("testing/5/"+d.id+"/a-node/color/set", 1, false, "rgb,4,5,6")
+			level.ParsedFormat()
+		}
+		sent <- true
+	}()
+	for i := 0; ; i++ {
+		if i%2 == 0 {
+			level.SetFormat("0:100:2")
+			level.SetUnit("W")
+		} else {
+			level.SetFormat("0:100")
+			level.SetUnit("A")
+		}
+		select {
+		case <-sent:
+		default:
+			continue
+		}
+		break
+	}
+
+	level.SetFormat("0:200")
+	level.SetUnit("W")
+	waitFor(t, "the last format", func() bool {
+		return f.retainedMessages()["testing/"+d.id+"/a-node/level/$format"] == "0:200"
+	})
+}
+
+func TestTransport_EventRetained(t *testing.T) {
+	f := newFakeTransport()
+	d := createTestDevice()
+	d.SetTransport(f)
+	p := d.NewNode("a-node", "Name a-node", "test", nil).Advertise("press", "Press", DtString)
+	p.SetRetained(false)
+	runTestDevice(t, d, f)
+
+	m := p.SetProperty()
+	m.Retained = true
+	m.Send("long")
+	waitFor(t, "the message", func() bool {
+		return f.publications(d.topic("a-node/press"), "long") > 0
+	})
+	if v := f.retainedMessages()[d.topic("a-node/press")]; v != "long" {
+		t.Errorf("press is retained as \"%s\"", v)
+	}
+}
+
+// A fakeTransport that records the messages that are not retained, with their QoS
+type eventTransport struct {
+	*fakeTransport
+	events []string
+}
+
+func (f *eventTransport) Publish(topic string, qos byte, retained bool, payload string) Token {
+	if !retained {
+		f.mutex.Lock()
+		f.events = append(f.events, fmt.Sprintf("%s %d %s", topic, qos, payload))
+		f.mutex.Unlock()
+	}
+	return f.fakeTransport.Publish(topic, qos, retained, payload)
+}
+
+func TestTransport_Event(t *testing.T) {
+	f := &eventTransport{fakeTransport: newFakeTransport()}
+	d := createTestDevice()
+	d.SetTransport(f)
+	d.SetProtocols(HomieV4 | HomieV5)
+	p := d.NewNode("a-node", "Name a-node", "test", nil).Advertise("press", "Press", DtEnum)
+	p.SetFormat("single,double")
+	p.SetRetained(false)
+	p.SetQos(2)
+	if err := try(func() { p.SetQos(3) }); err == nil {
+		t.Errorf("qos 3 was accepted")
+	}
+	p.SetProperty().SendEnum("single")
+
+	stop := runTestDevice(t, d, f.fakeTransport)
+	p.SetProperty().SendEnum("double")
+	waitFor(t, "the event", func() bool {
+		return f.publications("testing/5/"+d.id+"/a-node/press", "double") > 0
+	})
+	stop()
+
+	// Sent as it happens, with the property's QoS, and not kept
+	f.mutex.Lock()
+	events := strings.Join(f.events, ",")
+	f.mutex.Unlock()
+	expected := "testing/" + d.id + "/a-node/press 2 double," + "testing/5/" + d.id + "/a-node/press 2 double"
+	if events != expected {
+		t.Errorf("events are %s, expected %s", events, expected)
+	}
+	if v := p.getValue(0); v != "" {
+		t.Errorf("event value %s was kept", v)
+	}
+
+	retained := f.retainedMessages()
+	if v := retained["testing/"+d.id+"/a-node/press/$retained"]; v != "false" {
+		t.Errorf("$retained is \"%s\"", v)
+	}
+	for _, topic := range []string{"testing/" + d.id + "/a-node/press", "testing/5/" + d.id + "/a-node/press"} {
+		if v, ok := retained[topic]; ok {
+			t.Errorf("%s was retained as \"%s\"", topic, v)
+		}
+	}
+
+	// Controllers see it under both conventions
+	for _, protocol := range []int{HomieV4, HomieV5} {
+		controller := NewController("testing")
+		controller.SetProtocol(protocol)
+		for topic, payload := range retained {
+			controller.processMessage(topic, payload)
+		}
+		if cd := controller.Device(d.id); cd == nil || cd.Node("a-node") == nil || cd.Node("a-node").Property("press") == nil {
+			t.Errorf("protocol %d: controller did not find the property", protocol)
+		} else if cd.Node("a-node").Property("press").Retained() {
+			t.Errorf("protocol %d: controller thinks the property is retained", protocol)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package homie
+
+//
+// This file contains error returning versions of the configuration calls.
+// The plain versions panic on errors that are unlikely to be corrected.
+// These are for programs, such as bridges, whose configuration comes from
+// outside and may well be bad.
+//
+
+import (
+	"errors"
+)
+
+// Call f, and return the configuration panic it raises as an error.
+// Anything else, a nil pointer for example, is passed on.
+func try(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s, ok := r.(string)
+			if !ok {
+				panic(r)
+			}
+			err = errors.New(s)
+		}
+	}()
+
+	f()
+	return nil
+}
+
+func TryNewDevice(id, name string) (d *Device, err error) {
+	err = try(func() { d = NewDevice(id, name) })
+	return
+}
+
+func (device *Device) TrySetTopicBase(b string) error {
+	return try(func() { device.SetTopicBase(b) })
+}
+
+func (device *Device) TrySetLocalIP(ip string) error {
+	return try(func() { device.SetLocalIP(ip) })
+}
+
+func (device *Device) TrySetMac(mac string) error {
+	return try(func() { device.SetMac(mac) })
+}
+
+func (device *Device) TryNewNode(id, name, nType string, handler func(d *Device, n *Node, p *Property, a string) bool) (n *Node, err error) {
+	err = try(func() { n = device.NewNode(id, name, nType, handler) })
+	return
+}
+
+func (device *Device) TryNewSpan(id, name, nType string, lo, hi int,
+	handler func(d *Device, n *Node, index int, p *Property, value string) bool) (n *Node, err error) {
+	err = try(func() { n = device.NewSpan(id, name, nType, lo, hi, handler) })
+	return
+}
+
+func (n *Node) TryAdvertise(id, name string, dataType int) (p *Property, err error) {
+	err = try(func() { p = n.Advertise(id, name, dataType) })
+	return
+}
+
+func (p *Property) TrySetUnit(unit string) error {
+	return try(func() { p.SetUnit(unit) })
+}
+
+func (p *Property) TrySetFormat(format string) error {
+	return try(func() { p.SetFormat(format) })
+}
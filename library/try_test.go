@@ -0,0 +1,111 @@
+package homie
+
+// test the error returning versions of the configuration calls
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func expectTryError(t *testing.T, what string, err error, contains string) {
+	if err == nil {
+		t.Errorf("%s: no error", what)
+	} else if !strings.Contains(err.Error(), contains) {
+		t.Errorf("%s: error \"%v\" does not mention \"%s\"", what, err, contains)
+	}
+}
+
+func TestTry_Configuration(t *testing.T) {
+	d, err := TryNewDevice("try-device", "Try Device")
+	if err != nil || d == nil {
+		t.Fatalf("TryNewDevice failed: %v", err)
+	}
+	defer d.Destroy()
+
+	_, err = TryNewDevice("try-device", "Again")
+	expectTryError(t, "duplicate device", err, "Duplicate device id")
+	_, err = TryNewDevice("Living Room", "Living Room")
+	expectTryError(t, "invalid device id", err, "Invalid character")
+	_, err = TryNewDevice("", "Nobody")
+	expectTryError(t, "empty device id", err, "null identifier")
+	expectTryError(t, "topic base", d.TrySetTopicBase("-homie"), "may not begin")
+
+	n, err := d.TryNewNode("a-node", "A Node", "test", nil)
+	if err != nil || n == nil {
+		t.Fatalf("TryNewNode failed: %v", err)
+	}
+	_, err = d.TryNewNode("a-node", "Again", "test", nil)
+	expectTryError(t, "duplicate node", err, "already has a node")
+	_, err = d.TryNewSpan("relay", "Relay", "relay", 3, 1, nil)
+	expectTryError(t, "span range", err, "Invalid range")
+
+	p, err := n.TryAdvertise("level", "Level", DtInteger)
+	if err != nil || p == nil {
+		t.Fatalf("TryAdvertise failed: %v", err)
+	}
+	_, err = n.TryAdvertise("other", "Other", 99)
+	expectTryError(t, "data type", err, "Invalid data type")
+	expectTryError(t, "unit", p.TrySetUnit("furlongs"), "invalid unit furlongs for property")
+	expectTryError(t, "format", p.TrySetFormat("10:1"), "format \"10:1\"")
+
+	if err := p.TrySetUnit("%"); err != nil {
+		t.Errorf("TrySetUnit failed: %v", err)
+	}
+	if err := p.TrySetFormat("0:100"); err != nil {
+		t.Errorf("TrySetFormat failed: %v", err)
+	}
+
+	// A bad call leaves the configuration alone
+	if len(d.nodes) != 1 || len(n.properties) != 1 || p.format != "0:100" {
+		t.Errorf("configuration changed by failed calls")
+	}
+}
+
+func TestTry_OtherPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("runtime error was not passed on")
+		}
+	}()
+
+	var n *Node
+	n.TryAdvertise("level", "Level", DtInteger)
+}
+
+// Fails to connect
+type unreachableTransport struct {
+	*fakeTransport
+}
+
+func (u unreachableTransport) Connect(will *Will, onConnect func(), onLost func(err error)) Token {
+	return doneToken{err: errors.New("connection refused")}
+}
+
+func TestTry_ErrorHandler(t *testing.T) {
+	d := createTestDevice()
+	defer d.Destroy()
+	d.SetTransport(unreachableTransport{newFakeTransport()})
+
+	errorChannel := make(chan error, 1)
+	d.SetErrorHandler(func(d *Device, err error) {
+		errorChannel <- err
+	})
+
+	c, cfl := context.WithCancel(context.Background())
+	waitChannel := make(chan bool, 1)
+	go d.RunWithContext(c, waitChannel)
+
+	select {
+	case err := <-errorChannel:
+		expectTryError(t, "connect", err, "connection refused")
+	case <-time.After(time.Second):
+		t.Errorf("error handler was not called")
+	}
+
+	cfl()
+	for _ = range waitChannel {
+	}
+}
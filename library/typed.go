@@ -0,0 +1,147 @@
+package homie
+
+//
+// This file contains a generics based layer over Property.
+// The property's data type is inferred from the Go type of its value.
+//
+
+import (
+	"log"
+	"strconv"
+)
+
+// An enum value.  Use this rather than string to advertise an enum property.
+type Enum string
+
+// The Go types that a typed property may hold, and the data types they map to:
+//
+//	int64   integer
+//	float64 float
+//	bool    boolean
+//	string  string
+//	Enum    enum
+//	Color   color
+type PropertyValue interface {
+	int64 | float64 | bool | string | Enum | Color
+}
+
+type TypedProperty[T PropertyValue] struct {
+	property *Property
+}
+
+// Advertise a property whose data type is inferred from T.
+// Not for spans, whose values are per index; use Advertise() and SetSpanProperty().
+func AdvertiseTyped[T PropertyValue](n *Node, id, name string) *TypedProperty[T] {
+	var zero T
+
+	if n.span {
+		panic("Typed property " + id + " cannot be advertised in span " + n.id)
+	}
+
+	dataType := DtString
+	switch any(zero).(type) {
+	case int64:
+		dataType = DtInteger
+	case float64:
+		dataType = DtFloat
+	case bool:
+		dataType = DtBoolean
+	case Enum:
+		dataType = DtEnum
+	case Color:
+		dataType = DtColor
+	}
+
+	return &TypedProperty[T]{property: n.Advertise(id, name, dataType)}
+}
+
+// The underlying property.  Use it for SetUnit(), SetFormat(), and the like.
+func (tp *TypedProperty[T]) Property() *Property {
+	return tp.property
+}
+
+// Publish a new value.  Same rules as PropertyMessage.Send().
+func (tp *TypedProperty[T]) Set(value T) error {
+	m := tp.property.SetProperty()
+
+	switch v := any(value).(type) {
+	case int64:
+		return m.SendInt(v)
+	case float64:
+		return m.SendFloat(v)
+	case bool:
+		return m.SendBool(v)
+	case Enum:
+		return m.SendEnum(string(v))
+	case Color:
+		return m.SendColor(v)
+	case string:
+		return m.Send(v)
+	}
+	return nil
+}
+
+// The last value set.  Returns the zero value if no value has been set,
+// or if the last value set cannot be parsed.
+func (tp *TypedProperty[T]) Get() T {
+	var result any
+
+	value := tp.property.getValue(0)
+
+	switch any(*new(T)).(type) {
+	case int64:
+		result, _ = strconv.ParseInt(value, 10, 64)
+	case float64:
+		result, _ = strconv.ParseFloat(value, 64)
+	case bool:
+		result = value == "true"
+	case Enum:
+		result = Enum(value)
+	case Color:
+		result = parseColor(value)
+	case string:
+		result = value
+	}
+	return result.(T)
+}
+
+// Make the property settable.  The handler is called with each valid "set" value.
+// Errors returned by the handler are logged.
+func (tp *TypedProperty[T]) OnSet(handler func(value T) error) {
+	p := tp.property
+
+	call := func(value T) bool {
+		if err := handler(value); err != nil {
+			log.Printf("Set of property %s in node %s failed: %v\n", p.id, p.node.id, err)
+			return false
+		}
+		return true
+	}
+
+	switch any(*new(T)).(type) {
+	case int64:
+		p.SettableInt(func(d *Device, n *Node, p *Property, v int64) bool {
+			return call(any(v).(T))
+		})
+	case float64:
+		p.SettableFloat(func(d *Device, n *Node, p *Property, v float64) bool {
+			return call(any(v).(T))
+		})
+	case bool:
+		p.SettableBool(func(d *Device, n *Node, p *Property, v bool) bool {
+			return call(any(v).(T))
+		})
+	case Enum:
+		p.SettableEnum(func(d *Device, n *Node, p *Property, v string) bool {
+			return call(any(Enum(v)).(T))
+		})
+	case Color:
+		p.SettableColor(func(d *Device, n *Node, p *Property, v Color) bool {
+			return call(any(v).(T))
+		})
+	case string:
+		p.Settable(func(d *Device, n *Node, p *Property, v string) bool {
+			return call(any(v).(T))
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package homie
+
+// test the generics based property layer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTyped_DataTypes(t *testing.T) {
+	d := createTestDevice()
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+
+	checks := []struct {
+		p        *Property
+		dataType int
+	}{
+		{AdvertiseTyped[int64](n, "i", "I").Property(), DtInteger},
+		{AdvertiseTyped[float64](n, "f", "F").Property(), DtFloat},
+		{AdvertiseTyped[bool](n, "b", "B").Property(), DtBoolean},
+		{AdvertiseTyped[string](n, "s", "S").Property(), DtString},
+		{AdvertiseTyped[Enum](n, "e", "E").Property(), DtEnum},
+		{AdvertiseTyped[Color](n, "c", "C").Property(), DtColor},
+	}
+
+	for _, c := range checks {
+		if c.p.dataType != c.dataType {
+			t.Errorf("property %s has data type %s, expected %s",
+				c.p.id, dataTypeName(c.p.dataType), dataTypeName(c.dataType))
+		}
+	}
+
+	// Spans have a value per index, so no typed properties
+	span := d.NewSpan("relay", "Relay", "test", 1, 3, nil)
+	if err := try(func() { AdvertiseTyped[bool](span, "on", "On") }); err == nil {
+		t.Errorf("typed property advertised in a span")
+	}
+}
+
+func TestTyped_SetGet(t *testing.T) {
+	d := createTestDevice()
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+
+	f := AdvertiseTyped[float64](n, "temperature", "Temperature")
+	if f.Get() != 0 {
+		t.Errorf("unset float property reads %v", f.Get())
+	}
+	if err := f.Set(21.5); err != nil || f.Get() != 21.5 {
+		t.Errorf("float Set: err = %v, Get() = %v", err, f.Get())
+	}
+
+	e := AdvertiseTyped[Enum](n, "mode", "Mode")
+	e.Property().SetFormat("heat,cool")
+	if err := e.Set("cool"); err != nil || e.Get() != "cool" {
+		t.Errorf("enum Set: err = %v, Get() = %v", err, e.Get())
+	}
+	if err := e.Set("off"); err == nil {
+		t.Errorf("enum Set accepted a value not in the format")
+	}
+
+	c := AdvertiseTyped[Color](n, "color", "Color")
+	c.Property().SetFormat("rgb")
+	if err := c.Set(Color{1, 2, 3}); err != nil || c.Get() != (Color{1, 2, 3}) {
+		t.Errorf("color Set: err = %v, Get() = %v", err, c.Get())
+	}
+}
+
+func TestTyped_OnSet(t *testing.T) {
+	var got []bool
+
+	d := createTestDevice()
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+
+	b := AdvertiseTyped[bool](n, "on", "On")
+	b.OnSet(func(value bool) error {
+		got = append(got, value)
+		if !value {
+			return errors.New("cannot turn off")
+		}
+		return nil
+	})
+
+	if !b.Property().settable {
+		t.Errorf("OnSet did not make the property settable")
+	}
+
+	for _, v := range []string{"true", "yes", "false"} {
+		b.Property().setEvent(v)
+	}
+	if len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("boolean handler saw %v", got)
+	}
+}
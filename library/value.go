@@ -0,0 +1,203 @@
+package homie
+
+//
+// This file contains code to check property values against the
+// property's data type and format.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns nil if the value is legal for the property, else an error describing the problem.
+func (p *Property) checkValue(value string) error {
+	format, f := p.formats()
+
+	switch p.dataType {
+	case DtString:
+		return nil
+	case DtInteger:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return p.valueError(value, "is not an integer")
+		}
+		return p.checkRange(value, float64(v), &f)
+	case DtFloat:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || strings.ContainsAny(value, "xXpPiInN_") {
+			return p.valueError(value, "is not a float")
+		}
+		return p.checkRange(value, v, &f)
+	case DtBoolean:
+		if value != "true" && value != "false" {
+			return p.valueError(value, "is not \"true\" or \"false\"")
+		}
+		return nil
+	case DtEnum:
+		for _, e := range f.Values {
+			if value == e {
+				return nil
+			}
+		}
+		return p.valueError(value, "is not one of "+format)
+	case DtColor:
+		return p.checkColor(value, f.Color)
+	case DtDatetime:
+		if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			return p.valueError(value, "is not an ISO 8601 date and time")
+		}
+		return nil
+	case DtDuration:
+		if !durationPattern.MatchString(value) || value == "PT" {
+			return p.valueError(value, "is not an ISO 8601 duration")
+		}
+		return nil
+	case DtJSON:
+		if !json.Valid([]byte(value)) {
+			return p.valueError(value, "is not valid JSON")
+		}
+		return nil
+	}
+	return p.valueError(value, "has an unknown data type")
+}
+
+func (p *Property) valueError(value, problem string) error {
+	return fmt.Errorf("value \"%s\" for property %s in node %s %s", value, p.id, p.node.id, problem)
+}
+
+// Check a numeric value against the limits and step of the property's format.
+func (p *Property) checkRange(value string, v float64, f *PropertyFormat) error {
+	if f.HasMin && v < f.Min {
+		return p.valueError(value, "is less than "+formatFloat(f.Min))
+	}
+	if f.HasMax && v > f.Max {
+		return p.valueError(value, "is greater than "+formatFloat(f.Max))
+	}
+	if f.Step > 0 {
+		// steps are counted from min, else from max, else from zero
+		base := 0.0
+		if f.HasMin {
+			base = f.Min
+		} else if f.HasMax {
+			base = f.Max
+		}
+		steps := (v - base) / f.Step
+		if math.Abs(steps-math.Round(steps)) > 1e-9 {
+			return p.valueError(value, "is not a multiple of step "+formatFloat(f.Step))
+		}
+	}
+	return nil
+}
+
+// Homie does not allow exponent notation, so never use it.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// The Homie name of a data type, as published in $datatype
+func dataTypeName(dataType int) string {
+	switch dataType {
+	case DtString:
+		return "string"
+	case DtInteger:
+		return "integer"
+	case DtFloat:
+		return "float"
+	case DtBoolean:
+		return "boolean"
+	case DtEnum:
+		return "enum"
+	case DtColor:
+		return "color"
+	case DtDatetime:
+		return "datetime"
+	case DtDuration:
+		return "duration"
+	case DtJSON:
+		return "json"
+	}
+	return "unknown"
+}
+
+// The data type with the given name.  Returns false if there is no such data type.
+func dataTypeFromName(name string) (int, bool) {
+	for dataType := DtString; dataType <= DtJSON; dataType++ {
+		if dataTypeName(dataType) == name {
+			return dataType, true
+		}
+	}
+	return DtString, false
+}
+
+// The name of a data type as published in v4 $datatype.
+// v4 does not have the newer data types, so they are published as strings.
+func dataTypeNameV4(dataType int) string {
+	switch dataType {
+	case DtDatetime, DtDuration, DtJSON:
+		return "string"
+	}
+	return dataTypeName(dataType)
+}
+
+// An ISO 8601 duration, as limited by the v5 convention: PTxxHxxMxxS
+var durationPattern = regexp.MustCompile(`^PT([0-9]+H)?([0-9]+M)?([0-9]+(\.[0-9]+)?S)?$`)
+
+// Formats the color as a Homie color payload
+func (c Color) String() string {
+	return formatFloat(c[0]) + "," + formatFloat(c[1]) + "," + formatFloat(c[2])
+}
+
+// Upper limits for each component of the supported color formats
+var colorLimits map[string][3]float64 = map[string][3]float64{
+	"rgb": {255, 255, 255},
+	"hsv": {360, 100, 100},
+	"xyz": {1, 1, 1},
+}
+
+// Parse a color value that has already passed checkColor()
+func parseColor(value string) Color {
+	var c Color
+
+	for i, component := range strings.SplitN(value, ",", 3) {
+		c[i], _ = strconv.ParseFloat(component, 64)
+	}
+	return c
+}
+
+// Check a color value.  It must be three comma separated components
+// and each must be in range for the color format.
+func (p *Property) checkColor(value, color string) error {
+	limits, ok := colorLimits[color]
+	if !ok {
+		return p.valueError(value, "has no color format")
+	}
+
+	components := strings.Split(value, ",")
+	if len(components) != 3 {
+		return p.valueError(value, "is not a "+color+" triple")
+	}
+
+	for i, c := range components {
+		var (
+			v   float64
+			err error
+		)
+		if color == "xyz" {
+			v, err = strconv.ParseFloat(c, 64)
+		} else {
+			var n int64
+			n, err = strconv.ParseInt(c, 10, 64)
+			v = float64(n)
+		}
+		if err != nil || v < 0 || v > limits[i] {
+			return p.valueError(value, "has an out of range "+color+" component \""+c+"\"")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package homie
+
+// test the checking of property values
+
+import (
+	"testing"
+)
+
+func createValueTestProperty(dataType int, format string) *Property {
+	d := createTestDevice()
+	n := d.NewNode("a-node", "Name a-node", "test", nil)
+	p := n.Advertise("a-property", "Name a-property", dataType)
+	if len(format) > 0 {
+		p.SetFormat(format)
+	}
+	return p
+}
+
+func checkValues(t *testing.T, p *Property, good, bad []string) {
+	for _, v := range good {
+		if err := p.SetProperty().Send(v); err != nil {
+			t.Errorf("value %s rejected: %v", v, err)
+		}
+	}
+	for _, v := range bad {
+		if err := p.SetProperty().Send(v); err == nil {
+			t.Errorf("value %s accepted for format \"%s\"", v, p.format)
+		}
+	}
+}
+
+func TestValue_Integer(t *testing.T) {
+	p := createValueTestProperty(DtInteger, "")
+	checkValues(t, p, []string{"0", "-12", "123456"}, []string{"banana", "1.5", "", "1e3"})
+
+	p = createValueTestProperty(DtInteger, "-5:100")
+	checkValues(t, p, []string{"-5", "0", "100"}, []string{"-6", "101"})
+}
+
+func TestValue_Float(t *testing.T) {
+	p := createValueTestProperty(DtFloat, "")
+	checkValues(t, p, []string{"0", "-12.5", "1.5e3"}, []string{"banana", "", "NaN", "Inf", "0x10"})
+
+	p = createValueTestProperty(DtFloat, ":10.5")
+	checkValues(t, p, []string{"-1000", "10.5"}, []string{"10.6"})
+}
+
+func TestValue_Boolean(t *testing.T) {
+	p := createValueTestProperty(DtBoolean, "")
+	checkValues(t, p, []string{"true", "false"}, []string{"True", "1", "on", ""})
+}
+
+func TestValue_Enum(t *testing.T) {
+	p := createValueTestProperty(DtEnum, "low,medium,high")
+	checkValues(t, p, []string{"low", "high"}, []string{"Low", "", "low,medium"})
+}
+
+func TestValue_Color(t *testing.T) {
+	p := createValueTestProperty(DtColor, "rgb")
+	checkValues(t, p, []string{"0,0,0", "255,128,255"}, []string{"256,0,0", "1,2", "a,b,c", "-1,0,0"})
+
+	p = createValueTestProperty(DtColor, "hsv")
+	checkValues(t, p, []string{"360,100,100"}, []string{"100,101,0"})
+
+	p = createValueTestProperty(DtColor, "xyz")
+	checkValues(t, p, []string{"0.25,0.5,1"}, []string{"1.5,0,0"})
+}
+
+func TestValue_Strict(t *testing.T) {
+	p := createValueTestProperty(DtInteger, "")
+
+	// By default a bad value is reported, but still recorded
+	if err := p.SetProperty().Send("banana"); err == nil || p.value != "banana" {
+		t.Errorf("non-strict send: err = %v, value = \"%s\"", err, p.value)
+	}
+
+	p.node.device.SetStrictValues(true)
+	p.SetProperty().Send("12")
+	if err := p.SetProperty().Send("banana"); err == nil || p.value != "12" {
+		t.Errorf("strict send: err = %v, value = \"%s\"", err, p.value)
+	}
+}
+
+func TestValue_TypedSenders(t *testing.T) {
+	p := createValueTestProperty(DtFloat, "")
+	if err := p.SetProperty().SendFloat(1e21); err != nil || p.value != "1000000000000000000000" {
+		t.Errorf("SendFloat: err = %v, value = \"%s\"", err, p.value)
+	}
+	if err := p.SetProperty().SendInt(3); err == nil {
+		t.Errorf("SendInt accepted for a float property")
+	}
+
+	p = createValueTestProperty(DtInteger, "")
+	if err := p.SetProperty().SendInt(-42); err != nil || p.value != "-42" {
+		t.Errorf("SendInt: err = %v, value = \"%s\"", err, p.value)
+	}
+
+	p = createValueTestProperty(DtBoolean, "")
+	if err := p.SetProperty().SendBool(true); err != nil || p.value != "true" {
+		t.Errorf("SendBool: err = %v, value = \"%s\"", err, p.value)
+	}
+	if err := p.SetProperty().SendEnum("true"); err == nil {
+		t.Errorf("SendEnum accepted for a boolean property")
+	}
+
+	p = createValueTestProperty(DtEnum, "a,b")
+	if err := p.SetProperty().SendEnum("c"); err == nil {
+		t.Errorf("SendEnum accepted a value not in the format")
+	}
+
+	p = createValueTestProperty(DtColor, "rgb")
+	if err := p.SetProperty().SendColor(Color{255, 0, 16}); err != nil || p.value != "255,0,16" {
+		t.Errorf("SendColor: err = %v, value = \"%s\"", err, p.value)
+	}
+	if err := p.SetProperty().SendColor(Color{0.5, 0, 16}); err == nil {
+		t.Errorf("SendColor accepted a fractional rgb component")
+	}
+	if err := p.SetProperty().SendBool(false); err == nil || p.value != "0.5,0,16" {
+		t.Errorf("SendBool on a color property: err = %v, value = \"%s\"", err, p.value)
+	}
+}